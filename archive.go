@@ -0,0 +1,246 @@
+package lmail
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ArchiveCompression is the format the messages of an Archive are stored in.
+// Only compressions of the standard library are supported, zstd is not.
+type ArchiveCompression int
+
+const (
+	// ArchiveUncompressed stores messages as they are, this is the default.
+	ArchiveUncompressed ArchiveCompression = iota
+	// ArchiveGzip stores messages gzip compressed.
+	ArchiveGzip
+)
+
+// extension of the blob files of the compression
+func (c ArchiveCompression) extension() string {
+	if c == ArchiveGzip {
+		return ".gz"
+	}
+	return ""
+}
+
+// ArchiveRecord is a line of the journal of an Archive. It links a stored
+// message to the envelope of a transaction it was received in.
+type ArchiveRecord struct {
+	Hash       string    `json:"hash"`
+	Size       int64     `json:"size"`
+	QueueID    string    `json:"queue_id"`
+	SessionID  string    `json:"session_id,omitempty"`
+	From       string    `json:"from"`
+	Rcpts      []string  `json:"rcpts"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	ReceivedAt time.Time `json:"received_at"`
+	ArchivedAt time.Time `json:"archived_at"`
+	// true if the message was stored already and the blob was reused
+	Duplicate bool `json:"duplicate"`
+}
+
+// Archive is a mail Handler that stores every message once under its SHA-256
+// hash. The messages are kept below blobs/ in directories named after the
+// first two bytes of the hash, e.g. blobs/ab/cd/abcd.... Every mail the
+// Archive handles is recorded in the journal file journal.jsonl, a message
+// that was stored before is not stored again but gets another record. When
+// the DefaultMuxer passes a mail to the Archive for several recipients, the
+// message is therefore stored once with a record per recipient.
+type Archive struct {
+	// Compression of new blobs, blobs stored before keep their format.
+	Compression ArchiveCompression
+
+	root string
+	mu   sync.Mutex // serializes writes to the journal
+}
+
+// NewArchive returns an Archive in the directory root, it is created if it
+// does not exist.
+func NewArchive(root string) (*Archive, error) {
+	for _, dir := range []string{"blobs", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), MaildirCreateMode); err != nil {
+			return nil, fmt.Errorf("error creating directory %s: %s", dir, err)
+		}
+	}
+	return &Archive{root: root}, nil
+}
+
+// blobPath returns the path of the blob with the given hash without the
+// extension of the compression.
+func (a *Archive) blobPath(hash string) string {
+	return filepath.Join(a.root, "blobs", hash[0:2], hash[2:4], hash)
+}
+
+// findBlob returns the path of the blob with the given hash in any format or
+// an empty string if it is not stored.
+func (a *Archive) findBlob(hash string) string {
+	base := a.blobPath(hash)
+	for _, c := range []ArchiveCompression{ArchiveUncompressed, ArchiveGzip} {
+		if _, err := os.Stat(base + c.extension()); err == nil {
+			return base + c.extension()
+		}
+	}
+	return ""
+}
+
+// Open returns a reader for the message with the given hash.
+func (a *Archive) Open(hash string) (io.ReadCloser, error) {
+	if len(hash) != sha256.Size*2 {
+		return nil, errors.New("lmail: invalid hash")
+	}
+	path := a.findBlob(hash)
+	if path == "" {
+		return nil, os.ErrNotExist
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(path) != ".gz" {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipFile{zr, f}, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g *gzipFile) Close() error {
+	err := g.Reader.Close()
+	if ferr := g.f.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// store writes the message to a blob unless it is stored already. It returns
+// the hash and size of the message and whether it was a duplicate. The check
+// and the creation of the blob are one step, concurrent stores of a message
+// create it once.
+func (a *Archive) store(r io.Reader) (hash string, size int64, duplicate bool, err error) {
+	tmp, err := ioutil.TempFile(filepath.Join(a.root, "tmp"), "blob-")
+	if err != nil {
+		return "", 0, false, err
+	}
+	defer func() {
+		if tmp != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	h := sha256.New()
+	var w io.Writer = tmp
+	var zw *gzip.Writer
+	if a.Compression == ArchiveGzip {
+		zw = gzip.NewWriter(tmp)
+		w = zw
+	}
+	size, err = io.Copy(io.MultiWriter(w, h), r)
+	if err != nil {
+		return "", 0, false, err
+	}
+	if zw != nil {
+		if err = zw.Close(); err != nil {
+			return "", 0, false, err
+		}
+	}
+	hash = hex.EncodeToString(h.Sum(nil))
+	if a.findBlob(hash) != "" {
+		return hash, size, true, nil
+	}
+	if err = tmp.Sync(); err != nil {
+		return "", 0, false, err
+	}
+	if err = tmp.Close(); err != nil {
+		return "", 0, false, err
+	}
+	path := a.blobPath(hash) + a.Compression.extension()
+	if err = os.MkdirAll(filepath.Dir(path), MaildirCreateMode); err != nil {
+		return "", 0, false, err
+	}
+	// linking fails if the blob exists, so of two concurrent stores of the
+	// same message only one creates it and the other is a duplicate. The
+	// temporary file is removed either way.
+	if err = os.Link(tmp.Name(), path); os.IsExist(err) {
+		return hash, size, true, nil
+	} else if err != nil {
+		return "", 0, false, err
+	}
+	return hash, size, false, syncDir(filepath.Dir(path))
+}
+
+// journal appends the record to the journal and syncs it to disk.
+func (a *Archive) journal(record *ArchiveRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.OpenFile(filepath.Join(a.root, "journal.jsonl"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// HandleMail archives the mail.
+func (a *Archive) HandleMail(m *Mail) (int, error) {
+	return a.HandleMailContext(m.Context(), m)
+}
+
+// HandleMailContext archives the mail, if ctx is done before the message
+// was stored it is not archived.
+func (a *Archive) HandleMailContext(ctx context.Context, m *Mail) (int, error) {
+	hash, size, duplicate, err := a.store(&contextReader{ctx, m.RawReader()})
+	if err != nil {
+		log.Printf("Archive: could not store %s: %s", m.QueueID, err)
+		return CodeAborted, &SMTPError{CodeAborted, "4.3.0", "Could not archive message"}
+	}
+	record := &ArchiveRecord{
+		Hash:       hash,
+		Size:       size,
+		QueueID:    m.QueueID,
+		SessionID:  m.SessionID,
+		From:       m.From,
+		Rcpts:      m.Rcpts,
+		ReceivedAt: m.ReceivedAt,
+		ArchivedAt: time.Now(),
+		Duplicate:  duplicate,
+	}
+	if m.RemoteAddr != nil {
+		record.RemoteAddr = m.RemoteAddr.String()
+	}
+	if err := a.journal(record); err != nil {
+		log.Printf("Archive: could not journal %s: %s", m.QueueID, err)
+		return CodeAborted, &SMTPError{CodeAborted, "4.3.0", "Could not archive message"}
+	}
+	return CodeOk, nil
+}
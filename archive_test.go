@@ -0,0 +1,137 @@
+package lmail
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	dir := testDir(t)
+	archive, err := NewArchive(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive.Compression = ArchiveGzip
+	msg := "Subject: archived\n\nbody\n"
+	for _, rcpt := range []string{"a@example.net", "b@example.net"} {
+		if code := deliverTestMail(t, archive, rcpt, msg); code != CodeOk {
+			t.Fatalf("archiving failed with %d", code)
+		}
+	}
+	blobs, _ := filepath.Glob(filepath.Join(dir, "blobs", "*", "*", "*"))
+	if len(blobs) != 1 || filepath.Ext(blobs[0]) != ".gz" {
+		t.Fatalf("expected one compressed blob, got %v", blobs)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "journal.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []ArchiveRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record ArchiveRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 || records[0].Duplicate || !records[1].Duplicate || records[0].Hash != records[1].Hash {
+		t.Fatalf("unexpected journal %+v", records)
+	}
+	if records[1].Rcpts[0] != "b@example.net" || records[1].Size != int64(len(msg)) {
+		t.Errorf("wrong record %+v", records[1])
+	}
+
+	r, err := archive.Open(records[0].Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if b, err := ioutil.ReadAll(r); err != nil || string(b) != msg {
+		t.Errorf("archived message %q: %v", b, err)
+	}
+}
+
+func TestArchiveConcurrentStores(t *testing.T) {
+	dir := testDir(t)
+	archive, err := NewArchive(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var stored int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, duplicate, err := archive.store(strings.NewReader("Subject: race\n\nbody\n"))
+			if err != nil {
+				t.Error(err)
+			} else if !duplicate {
+				atomic.AddInt32(&stored, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if stored != 1 {
+		t.Errorf("message was stored %d times", stored)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "tmp")); len(files) != 0 {
+		t.Errorf("temporary files left: %d", len(files))
+	}
+}
+
+func TestJournal(t *testing.T) {
+	dir := testDir(t)
+	archive, err := NewArchive(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Chain(&NullHandler{}, Journal(archive, true, nil))
+	if code := deliverTestMail(t, h, "bcc@example.net", "Subject: journaled\n\nbody\n"); code != CodeOk {
+		t.Fatalf("delivery failed with %d", code)
+	}
+	blobs, _ := filepath.Glob(filepath.Join(dir, "blobs", "*", "*", "*"))
+	if len(blobs) != 1 {
+		t.Fatalf("expected one blob, got %v", blobs)
+	}
+	b, err := ioutil.ReadFile(blobs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Recipient: bcc@example.net\n", "Content-Type: message/rfc822\n\nSubject: journaled\n"} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("report does not contain %q: %s", want, b)
+		}
+	}
+
+	// mails the handler rejects are not archived
+	rejecting := HandlerFunc(func(m *Mail) (int, error) { return CodeNotTaken, nil })
+	h = Chain(rejecting, Journal(archive, true, nil))
+	if code := deliverTestMail(t, h, "rcpt@example.net", "Subject: rejected\n\nbody\n"); code != CodeNotTaken {
+		t.Errorf("rejected mail returned %d", code)
+	}
+	if blobs, _ := filepath.Glob(filepath.Join(dir, "blobs", "*", "*", "*")); len(blobs) != 1 {
+		t.Errorf("rejected mail was archived: %v", blobs)
+	}
+
+	// a mandatory journal that fails rejects the mail
+	failing := HandlerFunc(func(m *Mail) (int, error) { return CodeAborted, nil })
+	h = Chain(&NullHandler{}, Journal(failing, true, nil))
+	if code := deliverTestMail(t, h, "rcpt@example.net", "Subject: x\n\nbody\n"); code != CodeAborted {
+		t.Errorf("failed mandatory journal returned %d", code)
+	}
+	h = Chain(&NullHandler{}, Journal(failing, false, nil))
+	if code := deliverTestMail(t, h, "rcpt@example.net", "Subject: x\n\nbody\n"); code != CodeOk {
+		t.Errorf("failed optional journal returned %d", code)
+	}
+}
@@ -0,0 +1,297 @@
+package lmail
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultSpoolMemoryLimit is the number of bytes of a message that are kept
+// in memory before it is spooled to disk, if Server.SpoolMemoryLimit is zero.
+const DefaultSpoolMemoryLimit = 1 << 20
+
+// size of the memory chunks the message is stored in
+const chunkSize = 32 << 10
+
+var errBufferClosed = errors.New("mail buffer closed")
+
+// mailBuffer is an append only store for a message that is read from origin
+// once and can then be consumed by many readers at their own pace.
+//
+// The message is kept in fixed size chunks of memory up to limit bytes,
+// everything beyond is spooled to a temporary file. Bytes below size never
+// change once they are stored, so readers access them without locking. Only
+// readers that need data that has not been read from origin yet take the
+// lock: one of them becomes the filler and reads the next block from origin,
+// the others wait until it broadcasts that the store has grown.
+type mailBuffer struct {
+	origin io.Reader
+	limit  int64  // bytes kept in memory
+	dir    string // directory for the spool file, os.TempDir() if empty
+
+	size    int64           // bytes stored, accessed atomically
+	chunks  atomic.Value    // []*[chunkSize]byte, replaced when growing
+	file    atomic.Value    // *os.File, set once memory is exhausted
+	inMem   int64           // bytes in memory, set before file
+	closed  int32           // 1 once the buffer is closed, atomic
+	mu      sync.Mutex      // guards err and fill
+	cond    *sync.Cond      // broadcast whenever the store grows
+	err     error           // error of origin, io.EOF at the end
+	fill    bool            // true while a reader reads from origin
+	scratch [chunkSize]byte // read buffer for spooled data
+}
+
+func newMailBuffer(origin io.Reader, limit int64, dir string) *mailBuffer {
+	if limit <= 0 {
+		limit = DefaultSpoolMemoryLimit
+	}
+	b := &mailBuffer{
+		origin: origin,
+		limit:  limit,
+		dir:    dir,
+	}
+	b.cond = sync.NewCond(&b.mu)
+	b.chunks.Store([]*[chunkSize]byte{})
+	return b
+}
+
+// clone returns a new reader that starts at the beginning of the message.
+func (b *mailBuffer) clone() *mailReader {
+	return &mailReader{b: b}
+}
+
+func (b *mailBuffer) stored() int64 {
+	return atomic.LoadInt64(&b.size)
+}
+
+// readAt copies stored bytes at off into p without locking. It never reads
+// beyond the stored size.
+func (b *mailBuffer) readAt(p []byte, off int64) (n int, err error) {
+	if atomic.LoadInt32(&b.closed) == 1 {
+		return 0, errBufferClosed
+	}
+	size := b.stored()
+	if off >= size {
+		return 0, nil
+	}
+	if max := size - off; int64(len(p)) > max {
+		p = p[:max]
+	}
+	f, _ := b.file.Load().(*os.File)
+	inMem := size
+	if f != nil {
+		inMem = b.inMem
+	}
+	chunks := b.chunks.Load().([]*[chunkSize]byte)
+	for n < len(p) && off < inMem {
+		c := chunks[off/chunkSize][off%chunkSize:]
+		if rest := inMem - off; int64(len(c)) > rest {
+			c = c[:rest]
+		}
+		m := copy(p[n:], c)
+		n += m
+		off += int64(m)
+	}
+	if n < len(p) {
+		var m int
+		m, err = f.ReadAt(p[n:], off-inMem)
+		n += m
+	}
+	return
+}
+
+// wait blocks until more than want bytes are stored or origin is exhausted.
+// It returns the error of origin once everything is stored.
+func (b *mailBuffer) wait(want int64) error {
+	if b.stored() > want {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.stored() <= want && b.err == nil {
+		if b.fill {
+			b.cond.Wait()
+			continue
+		}
+		b.fill = true
+		b.mu.Unlock()
+		err := b.readOrigin()
+		b.mu.Lock()
+		b.fill = false
+		if err != nil {
+			b.err = err
+		}
+		b.cond.Broadcast()
+	}
+	if b.stored() > want {
+		return nil
+	}
+	return b.err
+}
+
+// readOrigin reads the next block from origin into the store. Only one
+// goroutine calls it at a time.
+func (b *mailBuffer) readOrigin() error {
+	if atomic.LoadInt32(&b.closed) == 1 {
+		return errBufferClosed
+	}
+	size := b.stored()
+	if b.file.Load() == nil && size < b.limit {
+		chunks := b.chunks.Load().([]*[chunkSize]byte)
+		if size == int64(len(chunks))*chunkSize {
+			chunks = append(chunks[:len(chunks):len(chunks)], new([chunkSize]byte))
+			b.chunks.Store(chunks)
+		}
+		// bytes beyond size are not visible to readers yet
+		c := chunks[size/chunkSize]
+		end := int64(chunkSize)
+		if rest := b.limit - size + size%chunkSize; rest < end {
+			end = rest
+		}
+		n, err := b.origin.Read(c[size%chunkSize : end])
+		atomic.AddInt64(&b.size, int64(n))
+		return err
+	}
+	f, _ := b.file.Load().(*os.File)
+	if f == nil {
+		var err error
+		f, err = ioutil.TempFile(b.dir, "lmail-spool-")
+		if err != nil {
+			return err
+		}
+		b.inMem = size
+		b.file.Store(f)
+		if atomic.LoadInt32(&b.closed) == 1 {
+			f.Close()
+			os.Remove(f.Name())
+			return errBufferClosed
+		}
+	}
+	n, err := b.origin.Read(b.scratch[:])
+	if n > 0 {
+		if _, werr := f.WriteAt(b.scratch[:n], size-b.inMem); werr != nil {
+			return werr
+		}
+		atomic.AddInt64(&b.size, int64(n))
+	}
+	return err
+}
+
+// close releases the memory and removes the spool file. Readers fail
+// afterwards.
+func (b *mailBuffer) close() error {
+	if !atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+		return nil
+	}
+	b.mu.Lock()
+	if b.err == nil {
+		b.err = errBufferClosed
+	}
+	b.cond.Broadcast()
+	b.mu.Unlock()
+	f, _ := b.file.Load().(*os.File)
+	if f == nil {
+		return nil
+	}
+	err := f.Close()
+	if rerr := os.Remove(f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// drain reads origin to the end, storing the data unless the buffer is
+// closed.
+func (b *mailBuffer) drain() error {
+	_, err := b.length()
+	if err != errBufferClosed {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.fill {
+		b.cond.Wait()
+	}
+	_, err = io.Copy(ioutil.Discard, b.origin)
+	return err
+}
+
+// mailReader reads a mailBuffer from the beginning. Each reader has its own
+// position, any number of them can read concurrently.
+type mailReader struct {
+	b   *mailBuffer
+	pos int64
+}
+
+// Read reads the next bytes of the message, it only blocks if they have not
+// been received yet.
+func (r *mailReader) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err = r.b.wait(r.pos); err != nil {
+		return 0, err
+	}
+	n, err = r.b.readAt(p, r.pos)
+	r.pos += int64(n)
+	return
+}
+
+// ReadAt reads len(p) bytes at off, blocking until they are received or the
+// message ended.
+func (r *mailReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("lmail: negative offset")
+	}
+	for n < len(p) {
+		if err = r.b.wait(off + int64(n)); err != nil {
+			return
+		}
+		var m int
+		m, err = r.b.readAt(p[n:], off+int64(n))
+		n += m
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Seek sets the position of the next Read. Seeking relative to the end
+// blocks until the whole message is received.
+func (r *mailReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		size, err := r.b.length()
+		if err != nil {
+			return r.pos, err
+		}
+		offset += size
+	default:
+		return r.pos, errors.New("lmail: invalid whence")
+	}
+	if offset < 0 {
+		return r.pos, errors.New("lmail: negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// length reads the whole message and returns its size.
+func (b *mailBuffer) length() (int64, error) {
+	for {
+		err := b.wait(b.stored())
+		if err == io.EOF {
+			return b.stored(), nil
+		}
+		if err != nil {
+			return b.stored(), err
+		}
+	}
+}
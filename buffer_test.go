@@ -0,0 +1,95 @@
+package lmail
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+)
+
+// slowReader returns at most n bytes per Read, like a network connection.
+type slowReader struct {
+	r io.Reader
+	n int
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	if len(p) > s.n {
+		p = p[:s.n]
+	}
+	return s.r.Read(p)
+}
+
+func testMessage(size int) []byte {
+	msg := make([]byte, size)
+	for i := range msg {
+		msg[i] = byte('a' + i%26)
+	}
+	return msg
+}
+
+func TestMailBufferConcurrentReaders(t *testing.T) {
+	msg := testMessage(200 << 10)
+	// keep 64k in memory, spool the rest
+	b := newMailBuffer(&slowReader{bytes.NewReader(msg), 1000}, 64<<10, "")
+	defer b.close()
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data, err := ioutil.ReadAll(&slowReader{b.clone(), 100 * (i + 1)})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(data, msg) {
+				t.Errorf("reader %d read a different message", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	r := b.clone()
+	p := make([]byte, 10)
+	if _, err := r.ReadAt(p, 150<<10); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, msg[150<<10:150<<10+10]) {
+		t.Fatal("ReadAt read wrong data")
+	}
+	end, err := r.Seek(-10, io.SeekEnd)
+	if err != nil || end != int64(len(msg)-10) {
+		t.Fatalf("Seek returned %d, %v", end, err)
+	}
+}
+
+func benchmarkMailBufferReaders(b *testing.B, readers int) {
+	msg := testMessage(1 << 20)
+	b.SetBytes(int64(len(msg) * readers))
+	for i := 0; i < b.N; i++ {
+		// origin delivers packet sized blocks, so readers have to wait for
+		// the filler
+		buf := newMailBuffer(&slowReader{bytes.NewReader(msg), 1500}, 0, "")
+		wg := &sync.WaitGroup{}
+		for j := 0; j < readers; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				io.CopyBuffer(ioutil.Discard, struct{ io.Reader }{buf.clone()}, make([]byte, 4096))
+			}()
+		}
+		wg.Wait()
+		buf.close()
+	}
+}
+
+func BenchmarkMailBufferReaders(b *testing.B) {
+	for _, readers := range []int{1, 2, 4, 8, 16, 32} {
+		b.Run(fmt.Sprintf("%d", readers), func(b *testing.B) {
+			benchmarkMailBufferReaders(b, readers)
+		})
+	}
+}
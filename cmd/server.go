@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	//	"fmt"
 	"io"
 	"io/ioutil"
@@ -8,6 +9,10 @@ import (
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 type PrintHandler struct {
@@ -57,6 +62,24 @@ func main() {
 	}
 	// Register The maildir at the muxer
 	mux.AddRcptHandler("doof@localhost", maildir)
-	// listen on port 2525 with the muxer
-	lmail.ListenAndServe(":2525", mux)
+	// listen on port 2525 with the muxer, log the time each mail takes and
+	// survive handler panics
+	srv := &lmail.Server{
+		Addr:    ":2525",
+		Handler: lmail.Chain(mux, lmail.Recover(nil), lmail.Timing(nil)),
+	}
+	// remove files of interrupted deliveries from the maildir
+	srv.RegisterOnShutdown(maildir.Janitor(0, 0))
+	// finish the mails in progress on interrupt
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			srv.Close()
+		}
+	}()
+	log.Println(srv.ListenAndServe())
 }
@@ -0,0 +1,83 @@
+package lmail
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"net"
+)
+
+// ContextHandler is a Handler that also takes the context of the mail
+// transaction. If the server's Handler implements ContextHandler,
+// HandleMailContext is called instead of HandleMail.
+//
+// The context carries the session ID, the remote address and the TLS state
+// of the session and is cancelled when the client disconnects, a timeout
+// expires or the processing time of the server has passed.
+type ContextHandler interface {
+	Handler
+	HandleMailContext(context.Context, *Mail) (int, error)
+}
+
+// handleMail calls the context aware variant of h if it has one.
+func handleMail(ctx context.Context, h Handler, m *Mail) (int, error) {
+	if ch, ok := h.(ContextHandler); ok {
+		return ch.HandleMailContext(ctx, m)
+	}
+	return h.HandleMail(m)
+}
+
+type contextKey struct {
+	name string
+}
+
+var (
+	sessionIDKey  = &contextKey{"session-id"}
+	remoteAddrKey = &contextKey{"remote-addr"}
+	tlsStateKey   = &contextKey{"tls-state"}
+)
+
+// SessionID returns the ID of the session the context belongs to or an empty
+// string.
+func SessionID(ctx context.Context) string {
+	id, _ := ctx.Value(sessionIDKey).(string)
+	return id
+}
+
+// RemoteAddr returns the address of the client of the session the context
+// belongs to or nil.
+func RemoteAddr(ctx context.Context) net.Addr {
+	addr, _ := ctx.Value(remoteAddrKey).(net.Addr)
+	return addr
+}
+
+// TLSState returns the TLS connection state of the session the context
+// belongs to, it returns nil if the session is not encrypted.
+func TLSState(ctx context.Context) *tls.ConnectionState {
+	state, _ := ctx.Value(tlsStateKey).(*tls.ConnectionState)
+	return state
+}
+
+// newID returns a random hex encoded ID.
+func newID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// contextReader stops reading once its context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
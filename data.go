@@ -0,0 +1,118 @@
+package lmail
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// maxLineLength is the limit of rfc5322 2.1.1 without the CRLF.
+const maxLineLength = 998
+
+// dataReader reads the message data of a DATA command like
+// textproto.DotReader does: dot-stuffing is removed, CRLF line endings are
+// converted to LF and the data ends with the line containing a single dot.
+// While it reads, it notes what it sees for the validation of the message.
+type dataReader struct {
+	r       *bufio.Reader
+	buf     []byte // data that was read but not returned yet
+	lineLen int    // length of the current line so far
+	cr      bool   // the last segment ended with a CR
+	done    bool
+	onEnd   func() // called once the final dot was read, may be nil
+
+	bareLF   bool // a line ended with a LF only
+	longLine bool // a line was longer than maxLineLength
+	eightBit bool // the data contains bytes outside of US-ASCII
+}
+
+func newDataReader(r *bufio.Reader) *dataReader {
+	return &dataReader{r: r}
+}
+
+func (d *dataReader) Read(p []byte) (n int, err error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err = d.readSegment(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// readSegment reads the next line, or as much of it as fits into the buffer of
+// the bufio.Reader.
+func (d *dataReader) readSegment() error {
+	line, err := d.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		err = nil
+	} else if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+	atStart := d.lineLen == 0 && !d.cr
+	if atStart && len(line) > 0 && line[0] == '.' {
+		if bytes.Equal(line, []byte(".\r\n")) || bytes.Equal(line, []byte(".\n")) {
+			d.done = true
+			if d.onEnd != nil {
+				d.onEnd()
+			}
+			return nil
+		}
+		line = line[1:]
+	}
+	d.buf = d.buf[:0]
+	if d.cr {
+		// the CR of the last segment was held back
+		if len(line) > 0 && line[0] == '\n' {
+			d.buf = append(d.buf, '\n')
+			line = line[1:]
+			if d.lineLen > maxLineLength {
+				d.longLine = true
+			}
+			d.lineLen = 0
+		} else {
+			d.buf = append(d.buf, '\r')
+			d.lineLen++
+		}
+		d.cr = false
+	}
+	for _, c := range line {
+		if c >= 0x80 {
+			d.eightBit = true
+			break
+		}
+	}
+	end := len(line)
+	switch {
+	case end > 0 && line[end-1] == '\n':
+		if end > 1 && line[end-2] == '\r' {
+			end -= 2
+		} else {
+			end--
+			d.bareLF = true
+		}
+		d.lineLen += end
+		d.buf = append(d.buf, line[:end]...)
+		d.buf = append(d.buf, '\n')
+		if d.lineLen > maxLineLength {
+			d.longLine = true
+		}
+		d.lineLen = 0
+		return nil
+	case end > 0 && line[end-1] == '\r':
+		d.cr = true
+		end--
+	}
+	d.lineLen += end
+	if d.lineLen > maxLineLength {
+		d.longLine = true
+	}
+	d.buf = append(d.buf, line[:end]...)
+	return nil
+}
@@ -0,0 +1,29 @@
+package lmail
+
+import (
+	"fmt"
+)
+
+// SMTPError is an error that carries the SMTP reply the client should
+// receive. If a Handler returns an SMTPError, the server replies with its
+// code, enhanced status code and message instead of a generic error reply.
+type SMTPError struct {
+	Code     int    // reply code, e.g. 451
+	Enhanced string // enhanced status code as in rfc3463, e.g. "4.3.0"
+	Message  string // human readable text
+}
+
+func (e *SMTPError) Error() string {
+	if e.Enhanced == "" {
+		return fmt.Sprintf("%d %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("%d %s %s", e.Code, e.Enhanced, e.Message)
+}
+
+// reply returns the reply text without the code.
+func (e *SMTPError) reply() string {
+	if e.Enhanced == "" {
+		return e.Message
+	}
+	return e.Enhanced + " " + e.Message
+}
@@ -0,0 +1,294 @@
+package lmail
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// PrependHeader adds a header field at the very top of the message. Readers
+// returned by RawReader afterwards start with the new field. Fields that are
+// added later end up above the ones added earlier, as trace fields do.
+//
+// The message itself is not buffered for this, the field is put in front of
+// the received data. Use Clone to add fields that only some handlers should
+// see.
+func (m *Mail) PrependHeader(key, value string) {
+	m.edit(headerEdit{editPrepend, key, value})
+}
+
+// AddHeader adds a header field at the end of the header.
+func (m *Mail) AddHeader(key, value string) {
+	m.edit(headerEdit{editAdd, key, value})
+}
+
+// DelHeader removes all header fields named key.
+func (m *Mail) DelHeader(key string) {
+	m.edit(headerEdit{editDel, key, ""})
+}
+
+// SetHeader replaces the header fields named key with a single field. It
+// takes the place of the first of them, if there is none it is added at the
+// end of the header.
+func (m *Mail) SetHeader(key, value string) {
+	m.edit(headerEdit{editSet, key, value})
+}
+
+// WrapBody transforms the body of the message. wrap is called for every
+// reader returned by RawReader afterwards with the body, after the changes
+// of earlier calls to WrapBody, and returns the new body.
+func (m *Mail) WrapBody(wrap func(io.Reader) io.Reader) {
+	m.wraps = append(m.wraps, wrap)
+	m.msg = nil
+}
+
+// Clone returns a copy of the mail that shares the message with m. Changes to
+// the envelope or the headers of the copy do not affect m.
+func (m *Mail) Clone() *Mail {
+	c := *m
+	c.Rcpts = append([]string(nil), m.Rcpts...)
+	c.edits = append([]headerEdit(nil), m.edits...)
+	c.wraps = append([]func(io.Reader) io.Reader(nil), m.wraps...)
+	c.msg = nil
+	return &c
+}
+
+const (
+	editPrepend = iota
+	editAdd
+	editDel
+	editSet
+)
+
+// headerEdit is a change of the header, they are applied in the order they
+// were made.
+type headerEdit struct {
+	op         int
+	key, value string
+}
+
+func (m *Mail) edit(e headerEdit) {
+	m.edits = append(m.edits, e)
+	m.msg = nil
+}
+
+// reader returns a reader for the message with all changes applied. As long
+// as only fields were prepended the header is not parsed.
+func (m *Mail) reader() io.Reader {
+	r := m.mailBuf.clone()
+	var head []byte
+	for _, e := range m.edits {
+		if e.op != editPrepend {
+			return &lazyReader{init: func() io.Reader { return m.rewrite(r) }}
+		}
+		head = append([]byte(formatHeader(e.key, e.value)), head...)
+	}
+	if len(m.wraps) > 0 {
+		return &lazyReader{init: func() io.Reader { return m.rewrite(r) }}
+	}
+	if len(head) == 0 {
+		return r
+	}
+	return &prependReader{head: head, r: r}
+}
+
+// headerField is a field of the header including its continuation lines.
+type headerField struct {
+	key string // canonical key
+	raw string
+}
+
+// rewrite reads the header from r, applies the edits and returns a reader
+// for the new header followed by the body passed through the wraps.
+func (m *Mail) rewrite(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	var fields []headerField
+	var err error
+	var rest string // first line that does not belong to the header
+	for {
+		var line string
+		line, err = br.ReadString('\n')
+		if line == "" {
+			break
+		}
+		if line == "\n" || line == "\r\n" {
+			rest = line
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += line
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 || strings.ContainsAny(line[:i], " \t") {
+			rest = line
+			break
+		}
+		fields = append(fields, headerField{textproto.CanonicalMIMEHeaderKey(line[:i]), line})
+		if err != nil {
+			break
+		}
+	}
+	for _, e := range m.edits {
+		fields = e.apply(fields)
+	}
+	var head bytes.Buffer
+	for _, f := range fields {
+		head.WriteString(f.raw)
+	}
+	head.WriteString(rest)
+	var body io.Reader = br
+	if err != nil {
+		body = &errReader{err}
+	}
+	for _, wrap := range m.wraps {
+		body = wrap(body)
+	}
+	return io.MultiReader(&head, body)
+}
+
+func (e headerEdit) apply(fields []headerField) []headerField {
+	key := textproto.CanonicalMIMEHeaderKey(e.key)
+	field := headerField{key, formatHeader(e.key, e.value)}
+	switch e.op {
+	case editPrepend:
+		return append([]headerField{field}, fields...)
+	case editAdd:
+		return append(fields, field)
+	}
+	var out []headerField
+	for _, f := range fields {
+		if f.key != key {
+			out = append(out, f)
+		} else if e.op == editSet {
+			out = append(out, field)
+			e.op = editDel
+		}
+	}
+	if e.op == editSet {
+		out = append(out, field)
+	}
+	return out
+}
+
+// lazyReader calls init on the first read and reads from the reader it
+// returns.
+type lazyReader struct {
+	init func() io.Reader
+	r    io.Reader
+}
+
+func (l *lazyReader) Read(p []byte) (int, error) {
+	if l.r == nil {
+		l.r = l.init()
+	}
+	return l.r.Read(p)
+}
+
+// errReader returns err on every read.
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+// formatHeader formats a header field. Long values have to be folded by the
+// caller.
+func formatHeader(key, value string) string {
+	return key + ": " + value + "\n"
+}
+
+// receivedHeader returns the value of a Received field as described in
+// rfc5321 4.4 for the mail received by the server named by.
+func (m *Mail) receivedHeader(by string) string {
+	var b strings.Builder
+	b.WriteString("from " + m.ClientName)
+	ip := ""
+	if m.RemoteAddr != nil {
+		ip = addrIP(m.RemoteAddr)
+	}
+	if m.Client != "" {
+		fmt.Fprintf(&b, " (%s [%s])", m.Client, ip)
+	} else {
+		fmt.Fprintf(&b, " ([%s])", ip)
+	}
+	b.WriteString("\n\tby " + by)
+	// protocol types as registered in rfc3848
+	with := "SMTP"
+	if m.ESMTP {
+		with = "ESMTP"
+		if m.TLS != nil {
+			with += "S"
+		}
+		if m.AuthIdentity != "" {
+			with += "A"
+		}
+	}
+	fmt.Fprintf(&b, " with %s id %s", with, m.QueueID)
+	// only name the recipient if there is just one, everything else would
+	// disclose the other recipients.
+	if len(m.Rcpts) == 1 {
+		fmt.Fprintf(&b, "\n\tfor <%s>", m.Rcpts[0])
+	}
+	b.WriteString("; " + m.ReceivedAt.Format(time.RFC1123Z))
+	return b.String()
+}
+
+// prependReader reads head followed by the message.
+type prependReader struct {
+	head []byte
+	r    *mailReader
+	pos  int64
+}
+
+func (p *prependReader) Read(b []byte) (n int, err error) {
+	if p.pos < int64(len(p.head)) {
+		n = copy(b, p.head[p.pos:])
+	} else {
+		p.r.pos = p.pos - int64(len(p.head))
+		n, err = p.r.Read(b)
+	}
+	p.pos += int64(n)
+	return
+}
+
+func (p *prependReader) ReadAt(b []byte, off int64) (n int, err error) {
+	if off < int64(len(p.head)) {
+		n = copy(b, p.head[off:])
+		if n == len(b) {
+			return
+		}
+	}
+	var m int
+	m, err = p.r.ReadAt(b[n:], off+int64(n)-int64(len(p.head)))
+	n += m
+	return
+}
+
+func (p *prependReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += p.pos
+	case io.SeekEnd:
+		size, err := p.r.b.length()
+		if err != nil {
+			return p.pos, err
+		}
+		offset += size + int64(len(p.head))
+	default:
+		return p.pos, errors.New("lmail: invalid whence")
+	}
+	if offset < 0 {
+		return p.pos, errors.New("lmail: negative position")
+	}
+	p.pos = offset
+	return offset, nil
+}
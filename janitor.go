@@ -0,0 +1,179 @@
+package lmail
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Defaults of the Maildir janitor. The maildir specification advises to
+// remove files from tmp that were not accessed for 36 hours.
+const (
+	DefaultTmpMaxAge       = 36 * time.Hour
+	DefaultJanitorInterval = time.Hour
+)
+
+// cleanTmp removes the files in dir that were not modified for maxAge. It
+// returns the number of files it found and removed.
+func cleanTmp(dir string, maxAge time.Duration) (found, removed int, err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, fi := range files {
+		if fi.IsDir() {
+			continue
+		}
+		found++
+		if maxAge <= 0 || time.Since(fi.ModTime()) < maxAge {
+			continue
+		}
+		if rerr := os.Remove(filepath.Join(dir, fi.Name())); rerr != nil && !os.IsNotExist(rerr) {
+			err = rerr
+			continue
+		}
+		removed++
+	}
+	return found, removed, err
+}
+
+// tmpDirs returns the tmp directories of the Maildir and its folders.
+func (m *Maildir) tmpDirs() []string {
+	dirs := []string{m.directory + "/tmp"}
+	folders, _ := filepath.Glob(m.directory + "/.*/tmp")
+	return append(dirs, folders...)
+}
+
+// reportTmp logs the files in tmp, they are left over from deliveries that
+// were interrupted.
+func (m *Maildir) reportTmp() {
+	for _, dir := range m.tmpDirs() {
+		if found, _, err := cleanTmp(dir, 0); err == nil && found > 0 {
+			log.Printf("Maildir: %d files left in %s", found, dir)
+		}
+	}
+}
+
+// CleanTmp removes files from the tmp directories of the Maildir and its
+// folders that are older than maxAge and returns their number. If maxAge is
+// zero, DefaultTmpMaxAge is used.
+func (m *Maildir) CleanTmp(maxAge time.Duration) (int, error) {
+	_, removed, err := cleanTmpDirs(m.tmpDirs(), orDefault(maxAge, DefaultTmpMaxAge))
+	return removed, err
+}
+
+// tmpDirs returns the tmp directories of all Maildirs of the store.
+func (s *MaildirStore) tmpDirs() ([]string, error) {
+	var dirs []string
+	err := filepath.Walk(s.root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() && fi.Name() == "tmp" && isMaildir(filepath.Dir(path)) {
+			dirs = append(dirs, path)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return dirs, err
+}
+
+// CleanTmp removes files older than maxAge from the tmp directories of all
+// Maildirs of the store and returns their number. If maxAge is zero,
+// DefaultTmpMaxAge is used.
+func (s *MaildirStore) CleanTmp(maxAge time.Duration) (int, error) {
+	dirs, err := s.tmpDirs()
+	if err != nil {
+		return 0, err
+	}
+	_, removed, err := cleanTmpDirs(dirs, orDefault(maxAge, DefaultTmpMaxAge))
+	return removed, err
+}
+
+// isMaildir reports whether dir has the new and cur directories of a
+// Maildir.
+func isMaildir(dir string) bool {
+	for _, sub := range []string{"new", "cur"} {
+		fi, err := os.Stat(filepath.Join(dir, sub))
+		if err != nil || !fi.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+func cleanTmpDirs(dirs []string, maxAge time.Duration) (found, removed int, err error) {
+	for _, dir := range dirs {
+		f, r, cerr := cleanTmp(dir, maxAge)
+		found += f
+		removed += r
+		if cerr != nil && !os.IsNotExist(cerr) && err == nil {
+			err = cerr
+		}
+	}
+	return
+}
+
+// startJanitor cleans the tmp directories returned by dirs right away and
+// then every interval until the returned function is called. The first run
+// reports all files it finds, they are left over from before the start.
+func startJanitor(interval, maxAge time.Duration, dirs func() ([]string, error)) (stop func()) {
+	maxAge = orDefault(maxAge, DefaultTmpMaxAge)
+	done := make(chan struct{})
+	run := func(first bool) {
+		d, err := dirs()
+		if err != nil {
+			log.Printf("Maildir: janitor failed: %s", err)
+			return
+		}
+		found, removed, err := cleanTmpDirs(d, maxAge)
+		if err != nil {
+			log.Printf("Maildir: janitor failed: %s", err)
+		}
+		if first && found > 0 {
+			log.Printf("Maildir: janitor found %d files left in tmp", found)
+		}
+		if removed > 0 {
+			log.Printf("Maildir: janitor removed %d stale files from tmp", removed)
+		}
+	}
+	go func() {
+		ticker := time.NewTicker(orDefault(interval, DefaultJanitorInterval))
+		defer ticker.Stop()
+		run(true)
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				run(false)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// Janitor periodically removes files older than maxAge from the tmp
+// directories of the Maildir, they are left over from deliveries that were
+// interrupted by a crash. Zero durations select the defaults. The returned
+// function stops the janitor, it can be registered with
+// Server.RegisterOnShutdown.
+func (m *Maildir) Janitor(interval, maxAge time.Duration) (stop func()) {
+	return startJanitor(interval, maxAge, func() ([]string, error) {
+		return m.tmpDirs(), nil
+	})
+}
+
+// Janitor is like Maildir.Janitor for all Maildirs of the store.
+func (s *MaildirStore) Janitor(interval, maxAge time.Duration) (stop func()) {
+	return startJanitor(interval, maxAge, s.tmpDirs)
+}
@@ -0,0 +1,97 @@
+package lmail
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// Journal returns a middleware that sends a journal report of every mail the
+// wrapped Handler accepts to archive, e.g. an Archive. The report is a
+// multipart message with the envelope of the transaction in a text part and
+// the message itself as message/rfc822 attachment, so the archive keeps the
+// recipients that are not named in the header, like blind copies. The report
+// is sent once the wrapped Handler accepted the mail, mails it rejects are
+// not archived.
+//
+// Failures of archive are logged to logger, or the standard logger if nil.
+// If mandatory is false they do not change the reply to the client,
+// otherwise the mail is rejected with 451 so the client sends it again. The
+// wrapped Handler has delivered the mail already at that point, so it sees
+// the retry as a second mail.
+func Journal(archive Handler, mandatory bool, logger *log.Logger) Middleware {
+	return func(next Handler) Handler {
+		return ContextHandlerFunc(func(ctx context.Context, m *Mail) (int, error) {
+			code, err := handleMail(ctx, next, m)
+			if err != nil || (code != 0 && code != CodeOk) {
+				return code, err
+			}
+			jcode, jerr := journal(ctx, archive, m)
+			if jerr == nil && (jcode == 0 || jcode == CodeOk) {
+				return code, err
+			}
+			loggerf(logger, "Journal of %s failed: %d %v", m.QueueID, jcode, jerr)
+			if mandatory {
+				return CodeAborted, &SMTPError{CodeAborted, "4.3.0", "Could not journal message"}
+			}
+			return code, err
+		})
+	}
+}
+
+// journal sends the journal report of m to archive. A panic in archive is
+// returned as an error, it must not take the accepted mail down with it.
+func journal(ctx context.Context, archive Handler, m *Mail) (code int, err error) {
+	report := journalReport(m)
+	defer report.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			code, err = CodeAborted, fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return handleMail(ctx, archive, report)
+}
+
+// journalReport returns a Mail with the same envelope as m whose message is
+// the journal report of m.
+func journalReport(m *Mail) *Mail {
+	boundary := "journal-" + newID()
+	var envelope strings.Builder
+	fmt.Fprintf(&envelope, "Sender: %s\n", m.From)
+	for _, rcpt := range m.Rcpts {
+		fmt.Fprintf(&envelope, "Recipient: %s\n", rcpt)
+	}
+	fmt.Fprintf(&envelope, "Queue-ID: %s\n", m.QueueID)
+	if m.SessionID != "" {
+		fmt.Fprintf(&envelope, "Session-ID: %s\n", m.SessionID)
+	}
+	if m.RemoteAddr != nil {
+		fmt.Fprintf(&envelope, "Client-Address: %s\n", m.RemoteAddr)
+	}
+	if m.ClientName != "" {
+		fmt.Fprintf(&envelope, "Client-Name: %s\n", m.ClientName)
+	}
+	if !m.ReceivedAt.IsZero() {
+		fmt.Fprintf(&envelope, "Received-At: %s\n", m.ReceivedAt.Format(time.RFC1123Z))
+	}
+
+	head := formatHeader("Date", time.Now().Format(time.RFC1123Z)) +
+		formatHeader("Subject", "Journal report "+m.QueueID) +
+		formatHeader("MIME-Version", "1.0") +
+		formatHeader("Content-Type", `multipart/mixed; boundary="`+boundary+`"`) +
+		"\n--" + boundary + "\n" +
+		formatHeader("Content-Type", "text/plain; charset=utf-8") + "\n" +
+		envelope.String() +
+		"\n--" + boundary + "\n" +
+		formatHeader("Content-Type", "message/rfc822") + "\n"
+	tail := "\n--" + boundary + "--\n"
+
+	report := m.Clone()
+	report.edits = nil
+	report.wraps = nil
+	report.PutMessage(io.MultiReader(strings.NewReader(head), m.RawReader(), strings.NewReader(tail)))
+	return report
+}
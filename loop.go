@@ -0,0 +1,40 @@
+package lmail
+
+import (
+	"strings"
+)
+
+// DefaultMaxHops is the number of Received fields a message may carry if
+// Server.MaxHops is zero. rfc5321 6.3 asks for a limit of at least 100.
+const DefaultMaxHops = 100
+
+func (srv *Server) maxHops() int {
+	if srv.MaxHops == 0 {
+		return DefaultMaxHops
+	}
+	return srv.MaxHops
+}
+
+// checkLoop reads the header of the mail and rejects it if it passed more
+// than maxHops servers or was already delivered to one of its recipients.
+// A negative maxHops disables the hop count.
+func checkLoop(m *Mail, maxHops int) error {
+	msg, err := m.MimeMessage()
+	if err != nil {
+		// not a message we can make sense of, that is not our business
+		// here.
+		return nil
+	}
+	if maxHops >= 0 && len(msg.Header["Received"]) > maxHops {
+		return &SMTPError{CodeTransactionFailed, "5.4.6", "Too many hops"}
+	}
+	for _, delivered := range msg.Header["Delivered-To"] {
+		delivered = getAddress(strings.TrimSpace(delivered))
+		for _, rcpt := range m.Rcpts {
+			if strings.EqualFold(delivered, rcpt) {
+				return &SMTPError{CodeTransactionFailed, "5.4.6", "Mail forwarding loop for " + rcpt}
+			}
+		}
+	}
+	return nil
+}
@@ -1,71 +1,16 @@
 package lmail
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/mail"
-	"sync"
+	"time"
 )
 
-// Takes care of the mail, Buffers it in memory.
-type mailBuffer struct {
-	buf *bytes.Buffer // Raw Buffer where mail is stored temporarily, NEVER read from this
-	// Fancy io.TeeRader, connected to the origin buffer and to buf.
-	// Read from this and the read content is written to buf transparently.
-	tee io.Reader
-	pos int64 // reader position
-	rm  *sync.Mutex
-}
-
-func newMailBuffer(origin io.Reader) *mailBuffer {
-	buf := &bytes.Buffer{}
-	b := &mailBuffer{
-		buf: buf,
-		tee: io.TeeReader(origin, buf),
-		rm:  &sync.Mutex{},
-	}
-	return b
-}
-
-// Clone a Buffer
-func (b *mailBuffer) clone() *mailBuffer {
-	return &mailBuffer{
-		tee: b.tee,
-		buf: b.buf,
-		pos: 0,
-		rm:  b.rm,
-	}
-}
-
-// Opportunistic Reader, Reads from origin buffer through the tee reader iff
-// the position has not been read before.
-// TODO: get rid of that silly lock.
-func (b *mailBuffer) Read(p []byte) (n int, err error) {
-	b.rm.Lock()
-	n, err = b.tee.Read(p)
-	if err != nil {
-		if err != io.EOF {
-			b.rm.Unlock()
-			return
-		}
-	}
-	if n > 0 && err != io.EOF {
-		b.pos = b.pos + int64(n)
-		b.rm.Unlock()
-		return
-	}
-	if int64(len(b.buf.Bytes())) < b.pos {
-		panic("Well this shouldn't happen")
-	}
-	data := b.buf.Bytes()
-	b.rm.Unlock()
-	n, err = bytes.NewReader(data).ReadAt(p, b.pos)
-	b.pos = b.pos + int64(n)
-	return
-}
-
 // Mail type represents mail data and is passed between handlers.
 //
 // Data is only read from the connection when it is read from either the
@@ -81,19 +26,104 @@ type Mail struct {
 	From string
 	// Slice of reciepients as registered by the client
 	Rcpts []string
+	// ESMTP parameters given with MAIL FROM, e.g. SIZE or BODY. Keywords
+	// are upper case.
+	Params map[string]string
+
+	// Unique ID of the mail transaction
+	QueueID string
+	// ID of the session the mail was received in
+	SessionID string
+	// Time the client connected
+	ConnectedAt time.Time
+	// Time the DATA command was received
+	ReceivedAt time.Time
+	// Addresses of the client and the server side of the connection
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+	// State of the TLS connection, nil if the mail was received unencrypted
+	TLS *tls.ConnectionState
+	// Identity the client authenticated as, empty if it did not
+	AuthIdentity string
+	// True if the client greeted with EHLO instead of HELO
+	ESMTP bool
+	// Problems found while validating the message, each is an *SMTPError.
+	// Empty if the server does not validate messages.
+	Violations []error
+	// Envelope recipients that are not named in the message header and
+	// header recipients that are not in the envelope. Only set if the
+	// server checks recipients, see RecipientCheck.
+	EnvelopeOnly []string
+	HeaderOnly   []string
+	// Changes of the header and the body
+	edits []headerEdit
+	wraps []func(io.Reader) io.Reader
 	// Parsed Message
 	msg *mail.Message
+	// context of the transaction
+	ctx context.Context
+}
+
+// Context returns the context of the mail transaction. It is the context
+// passed to ContextHandlers and is cancelled when the client disconnects, a
+// timeout expires or the time the server gives a Handler for processing the
+// mail has passed. If the mail was not received by a server the background
+// context is returned.
+func (m *Mail) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
 }
 
 // PutMessage puts a raw mail to the buffer. Takes an io.Reader as an argument.
+// Messages larger than DefaultSpoolMemoryLimit are spooled to a temporary
+// file, call Close to remove it.
 func (m *Mail) PutMessage(raw io.Reader) {
-	m.mailBuf = newMailBuffer(raw)
+	m.putMessage(raw, 0, "")
+}
+
+// putMessage puts a raw mail to the buffer, keeping up to limit bytes in
+// memory and spooling the rest to a file in dir.
+func (m *Mail) putMessage(raw io.Reader, limit int64, dir string) {
+	m.mailBuf = newMailBuffer(raw, limit, dir)
+}
+
+// Size returns the number of bytes of the message received so far. Once the
+// message was received completely, e.g. after Receive, it is the size of the
+// message.
+func (m *Mail) Size() int64 {
+	if m.mailBuf == nil {
+		return 0
+	}
+	return m.mailBuf.stored()
 }
 
-// RawReader returns a raw Reader for the Message. The returned reader can be 
-// read from several goroutines simultaniously.
+// Receive blocks until the whole message has been received from the client.
+// It returns an error if the message could not be received completely,
+// e.g. because the client disconnected.
+func (m *Mail) Receive() error {
+	_, err := m.mailBuf.length()
+	return err
+}
+
+// Close releases the buffered message and removes its spool file. Readers
+// returned by RawReader fail afterwards.
+func (m *Mail) Close() error {
+	if m.mailBuf == nil {
+		return nil
+	}
+	return m.mailBuf.close()
+}
+
+// RawReader returns a raw Reader for the Message. Every call returns a new
+// reader that starts at the beginning of the message, any number of them can
+// be read from several goroutines simultaniously. The reader reflects the
+// changes made by the header and body methods of Mail. As long as no other
+// changes than PrependHeader were made, the returned reader also implements
+// io.ReaderAt and io.Seeker.
 func (m *Mail) RawReader() io.Reader {
-	return m.mailBuf.clone()
+	return m.reader()
 }
 
 // MimeMessage returns the mime header from the message. If the header could
@@ -114,7 +144,12 @@ type NullHandler struct{}
 
 // HandleMail callback that just discards the mail.
 func (d *NullHandler) HandleMail(m *Mail) (code int, err error) {
-	n, err := io.Copy(ioutil.Discard, m.RawReader())
+	return d.HandleMailContext(m.Context(), m)
+}
+
+// HandleMailContext discards the mail and stops reading once ctx is done.
+func (d *NullHandler) HandleMailContext(ctx context.Context, m *Mail) (code int, err error) {
+	n, err := io.Copy(ioutil.Discard, &contextReader{ctx, m.RawReader()})
 	if err != nil {
 		return 500, err
 	}
@@ -0,0 +1,136 @@
+package lmail
+
+import (
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testDir returns a temporary directory that is removed when the test ends.
+func testDir(t testing.TB) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "lmail-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// newTestMail returns a mail from sender@example.org to rcpts with msg as
+// its message.
+func newTestMail(msg io.Reader, rcpts ...string) *Mail {
+	m := &Mail{From: "sender@example.org", Rcpts: rcpts}
+	m.PutMessage(msg)
+	return m
+}
+
+// deliverTestMail passes a mail to rcpt to h and returns the reply code.
+func deliverTestMail(t *testing.T, h Handler, rcpt, msg string) int {
+	m := newTestMail(strings.NewReader(msg), rcpt)
+	defer m.Close()
+	code, _ := h.HandleMail(m)
+	return code
+}
+
+func TestMailSpool(t *testing.T) {
+	dir := testDir(t)
+
+	m := &Mail{}
+	m.putMessage(strings.NewReader(mailstring), 64, dir)
+	data, err := ioutil.ReadAll(m.RawReader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != mailstring {
+		t.Fatalf("read %q, want %q", data, mailstring)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("expected one spool file, found %d", len(files))
+	}
+	data, err = ioutil.ReadAll(m.RawReader())
+	if err != nil || string(data) != mailstring {
+		t.Fatalf("second reader read %q: %v", data, err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, _ = ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Fatalf("spool file was not removed")
+	}
+}
+
+func TestPrependHeader(t *testing.T) {
+	m := newTestMail(strings.NewReader(mailstring), "rcpt@example.net")
+	m.PrependHeader("Received", "from localhost")
+	c := m.Clone()
+	c.PrependHeader("Return-Path", "<sender@example.org>")
+
+	data, err := ioutil.ReadAll(c.RawReader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Return-Path: <sender@example.org>\nReceived: from localhost\n" + mailstring
+	if string(data) != want {
+		t.Fatalf("read %q, want %q", data, want)
+	}
+	data, _ = ioutil.ReadAll(m.RawReader())
+	if string(data) != "Received: from localhost\n"+mailstring {
+		t.Fatalf("clone changed the original mail: %q", data)
+	}
+	p := make([]byte, 8)
+	if _, err := c.RawReader().(io.ReaderAt).ReadAt(p, 30); err != nil {
+		t.Fatal(err)
+	}
+	if string(p) != want[30:38] {
+		t.Fatalf("ReadAt read %q, want %q", p, want[30:38])
+	}
+}
+
+func TestHeaderEdits(t *testing.T) {
+	m := &Mail{}
+	m.PutMessage(strings.NewReader("Subject: old\nBcc: hidden@example.org\nTo: a@example.org,\n b@example.org\n\nbody\n"))
+	m.DelHeader("bcc")
+	m.SetHeader("Subject", "new")
+	c := m.Clone()
+	c.AddHeader("X-Spam-Status", "No")
+	c.PrependHeader("Received", "from localhost")
+	c.WrapBody(func(r io.Reader) io.Reader {
+		return io.MultiReader(r, strings.NewReader("-- \nfooter\n"))
+	})
+
+	data, err := ioutil.ReadAll(c.RawReader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Received: from localhost\nSubject: new\nTo: a@example.org,\n b@example.org\nX-Spam-Status: No\n\nbody\n-- \nfooter\n"
+	if string(data) != want {
+		t.Fatalf("read %q, want %q", data, want)
+	}
+	data, _ = ioutil.ReadAll(m.RawReader())
+	want = "Subject: new\nTo: a@example.org,\n b@example.org\n\nbody\n"
+	if string(data) != want {
+		t.Fatalf("read %q, want %q", data, want)
+	}
+}
+
+func TestMatchRecipients(t *testing.T) {
+	msg, err := mail.ReadMessage(strings.NewReader("To: A <a@example.org>, c@example.org\nCc: B@Example.org\n\nbody\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcpts := []string{"a@example.org", "b@example.org", "bcc@example.org", "bcc@example.org"}
+	envelopeOnly, headerOnly := matchRecipients(rcpts, msg.Header)
+	if !reflect.DeepEqual(envelopeOnly, []string{"bcc@example.org"}) {
+		t.Errorf("wrong envelope-only recipients: %v", envelopeOnly)
+	}
+	if !reflect.DeepEqual(headerOnly, []string{"c@example.org"}) {
+		t.Errorf("wrong header-only recipients: %v", headerOnly)
+	}
+}
@@ -1,11 +1,16 @@
 package lmail
 
 import (
+	"context"
+	"crypto/rand"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,34 +20,125 @@ var MaildirCreateMode os.FileMode = 0700
 
 // Maildir is a mail Handler That saves into a maildir. Maildir is an easy way
 // to store mails. For reference how to retrieve mail from a maildir refer to:
-// 	http://cr.yp.to/proto/maildir.html
+//
+//	http://cr.yp.to/proto/maildir.html
+//
 // This maildir implementation is supposed to read incoming mails from the
 // receiving Socket into a new File in the maildirs /tmp directory and then
 // move it to /new.
 type Maildir struct {
 	// specify where maildir structure starts
 	directory string
+
+	// ReturnPath adds a Return-Path field with the envelope sender to
+	// delivered mails, DeliveredTo a Delivered-To field for each
+	// recipient.
+	ReturnPath  bool
+	DeliveredTo bool
+
+	// Quota limits the size of the Maildir including its folders, it is
+	// tracked in a Maildir++ maildirsize file. QuotaPolicy decides how
+	// mails are rejected that do not fit.
+	Quota       Quota
+	QuotaPolicy QuotaPolicy
+
+	// Index records every delivered mail in a sidecar index file, see
+	// MaildirIndexEntry.
+	Index bool
+
+	// Maildir the folder belongs to, nil for the Maildir itself
+	parent *Maildir
 }
 
-func createUniqueName() (string, error) {
-	unixNano := time.Now().UnixNano()
-	pid := os.Getpid()
+// deliveries counts the files created by this process, it is the Q part of
+// unique names.
+var deliveries uint64
+
+// maildirHostname returns the hostname for unique names with "/" and ":"
+// replaced as the maildir specification demands.
+func maildirHostname() (string, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("%d.%d.%s", unixNano, pid, hostname), nil
+	hostname = strings.Replace(hostname, "/", "\\057", -1)
+	hostname = strings.Replace(hostname, ":", "\\072", -1)
+	return hostname, nil
+}
+
+// createUniqueName returns a name for a new file in tmp as described in
+// http://cr.yp.to/proto/maildir.html: the seconds, then M and the
+// microseconds, P and the process ID, Q and the number of deliveries of this
+// process, R and random bytes and finally the hostname. The inode of the file
+// is added when it is delivered.
+func createUniqueName() (string, error) {
+	now := time.Now()
+	hostname, err := maildirHostname()
+	if err != nil {
+		return "", err
+	}
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d.M%dP%dQ%dR%x.%s", now.Unix(), now.Nanosecond()/1000,
+		os.Getpid(), atomic.AddUint64(&deliveries, 1), random, hostname), nil
+}
+
+// deliveredName adds the inode and device number of the file to its unique
+// name, if the system has them, followed by the size of the file and its
+// virtual size, the size with CRLF line endings.
+func deliveredName(name string, fi os.FileInfo, vsize int64) string {
+	sizes := fmt.Sprintf(",S=%d,W=%d", fi.Size(), vsize)
+	ino, dev, ok := fileInode(fi)
+	parts := strings.SplitN(name, ".", 3)
+	if !ok || len(parts) != 3 {
+		return name + sizes
+	}
+	return fmt.Sprintf("%s.%sI%xV%x.%s%s", parts[0], parts[1], ino, dev, parts[2], sizes)
+}
+
+// bareLFCounter counts the line feeds that are not preceded by a carriage
+// return, each of them adds one byte to the virtual size of a message.
+type bareLFCounter struct {
+	n    int64
+	last byte
+}
+
+func (c *bareLFCounter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b == '\n' && c.last != '\r' {
+			c.n++
+		}
+		c.last = b
+	}
+	return len(p), nil
+}
+
+// syncDir flushes the entries of the directory to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 // NewMaildir creates a new maildir at the given location. If the underlying
 // directory structure does not exist, it is created. It returns a usable
-// maildir struct and any errors the occure during initialisation.
+// maildir struct and any errors the occure during initialisation. Files left
+// in tmp by an earlier crash are logged, see Janitor to remove them.
 func NewMaildir(dir string) (*Maildir, error) {
 	m := &Maildir{directory: dir}
 	err := m.create()
 	if err != nil {
 		return nil, err
 	}
+	m.reportTmp()
 	return m, nil
 }
 
@@ -65,37 +161,101 @@ func (m *Maildir) create() error {
 	return nil
 }
 
+// Folder returns the Maildir++ subfolder with the given name, it is created
+// if it does not exist. Nested folders are separated by dots or slashes, e.g.
+// "Archive.2024". An empty name returns m itself.
+func (m *Maildir) Folder(name string) (*Maildir, error) {
+	if name == "" {
+		return m, nil
+	}
+	name = strings.Replace(name, "/", ".", -1)
+	for _, part := range strings.Split(name, ".") {
+		if part == "" {
+			return nil, fmt.Errorf("invalid folder name %q", name)
+		}
+	}
+	f := &Maildir{
+		directory:   m.quotaRoot().directory + "/." + name,
+		ReturnPath:  m.ReturnPath,
+		DeliveredTo: m.DeliveredTo,
+		Index:       m.Index,
+		parent:      m.quotaRoot(),
+	}
+	if err := f.create(); err != nil {
+		return nil, err
+	}
+	// marks the directory as a folder for Maildir++ readers
+	marker, err := os.OpenFile(f.directory+"/maildirfolder", os.O_WRONLY|os.O_CREATE, MaildirCreateMode)
+	if err != nil {
+		return nil, fmt.Errorf("error creating maildirfolder: %s", err)
+	}
+	marker.Close()
+	return f, nil
+}
+
 // Deliver an email. If the mail was regarded as ok it shall be deliverd.
 // This method only takes a string of the maildir file and moves it from
-// tmp to new
+// tmp to new. The file must have been synced to disk before, the new
+// directory is synced after the file was moved.
 func (m *Maildir) Deliver(f string) error {
-	name := path.Base(f)
-	return os.Rename(f, m.directory+"/new/"+name+":2,")
+	file, err := os.Open(f)
+	if err != nil {
+		return err
+	}
+	counter := &bareLFCounter{}
+	_, err = io.Copy(counter, file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	_, err = m.deliver(f, counter.n)
+	return err
+}
 
+// deliver moves the file f to new and returns its new name. bareLFs is the
+// number of line feeds without carriage return in the file.
+func (m *Maildir) deliver(f string, bareLFs int64) (string, error) {
+	fi, err := os.Stat(f)
+	if err != nil {
+		return "", err
+	}
+	name := deliveredName(path.Base(f), fi, fi.Size()+bareLFs)
+	err = os.Rename(f, m.directory+"/new/"+name)
+	if err != nil {
+		return "", err
+	}
+	return name, syncDir(m.directory + "/new")
 }
 
 // StoreTmp stores a mail in the maildir. takes a reader and returns how many
-// bytes where read and an error
+// bytes where read and an error. The file is synced to disk before it is
+// returned, if storing fails it is removed.
 func (m *Maildir) StoreTmp(reader io.Reader) (int64, *os.File, error) {
+	return m.storeTmp(reader, ioutil.Discard)
+}
+
+// storeTmp is StoreTmp, everything that is stored is also written to w.
+func (m *Maildir) storeTmp(reader io.Reader, w io.Writer) (int64, *os.File, error) {
 	unique, err := createUniqueName()
 	if err != nil {
 		return 0, nil, err
 	}
 	filename := m.directory + "/tmp/" + unique
-	file, err := os.Create(filename)
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, MaildirCreateMode)
 	if err != nil {
 		return 0, nil, err
 	}
-	err = file.Chmod(MaildirCreateMode)
-	if err != nil {
-		return 0, nil, err
+	n, err := io.Copy(io.MultiWriter(file, w), reader)
+	if err == nil {
+		err = file.Sync()
 	}
-	n, err := io.Copy(file, reader)
-	if err != nil {
-		return 0, nil, err
+	if err == nil {
+		_, err = file.Seek(0, 0)
 	}
-	_, err = file.Seek(0, 0)
 	if err != nil {
+		// partial files must not stay in tmp
+		file.Close()
+		os.Remove(filename)
 		return 0, nil, err
 	}
 	log.Printf("Maildir: saved %d bytes into %s\n", n, filename)
@@ -104,10 +264,52 @@ func (m *Maildir) StoreTmp(reader io.Reader) (int64, *os.File, error) {
 
 // HandleMail is a simple handler, for mails that shall be stored.
 func (m *Maildir) HandleMail(mail *Mail) (code int, err error) {
-	_, f, err := m.StoreTmp(mail.RawReader())
+	return m.HandleMailContext(mail.Context(), mail)
+}
+
+// HandleMailContext stores the mail like HandleMail. If ctx is done before the
+// mail is stored, it is not delivered.
+func (m *Maildir) HandleMailContext(ctx context.Context, mail *Mail) (code int, err error) {
+	if m.ReturnPath || m.DeliveredTo {
+		mail = mail.Clone()
+		if m.DeliveredTo {
+			for _, rcpt := range mail.Rcpts {
+				mail.PrependHeader("Delivered-To", rcpt)
+			}
+		}
+		if m.ReturnPath {
+			mail.PrependHeader("Return-Path", "<"+mail.From+">")
+		}
+	}
+	counter := &bareLFCounter{}
+	n, f, err := m.storeTmp(&contextReader{ctx, mail.RawReader()}, counter)
+	if err != nil {
+		log.Printf("Maildir: could not store %s: %s", mail.QueueID, err)
+		return CodeAborted, &SMTPError{CodeAborted, "4.3.0", "Could not store message"}
+	}
+	f.Close()
+	if err := m.checkQuota(n); err != nil {
+		os.Remove(f.Name())
+		if serr, ok := err.(*SMTPError); ok {
+			return serr.Code, serr
+		}
+		log.Printf("Maildir: could not check quota for %s: %s", mail.QueueID, err)
+		return CodeAborted, &SMTPError{CodeAborted, "4.3.0", "Could not deliver message"}
+	}
+	name, err := m.deliver(f.Name(), counter.n)
 	if err != nil {
-		return 500, err
+		os.Remove(f.Name())
+		log.Printf("Maildir: could not deliver %s: %s", mail.QueueID, err)
+		return CodeAborted, &SMTPError{CodeAborted, "4.3.0", "Could not deliver message"}
+	}
+	if m.Index {
+		if err := m.appendIndex(name, mail); err != nil {
+			log.Printf("Maildir: could not index %s: %s", mail.QueueID, err)
+		}
+	}
+	if err := m.addQuota(n); err != nil {
+		// the mail is delivered, maildirsize is recalculated later
+		log.Printf("Maildir: could not update quota for %s: %s", mail.QueueID, err)
 	}
-	m.Deliver(f.Name())
-	return 250, nil
+	return CodeOk, nil
 }
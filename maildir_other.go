@@ -0,0 +1,11 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package lmail
+
+import "os"
+
+// fileInode reports that the system has no inode numbers.
+func fileInode(fi os.FileInfo) (ino, dev uint64, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,202 @@
+package lmail
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaildirReader(t *testing.T) {
+	dir := testDir(t)
+	md, err := NewMaildir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md.ReturnPath = true
+	md.DeliveredTo = true
+	md.Index = true
+	for _, subject := range []string{"one", "two"} {
+		if code := deliverTestMail(t, md, "rcpt@example.net", "Subject: "+subject+"\n\nbody\n"); code != CodeOk {
+			t.Fatalf("delivery failed with %d", code)
+		}
+	}
+
+	messages, err := md.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	msg := messages[0]
+	if msg.Dir != "new" || msg.Flags != "" || strings.Contains(msg.Path(), ":") {
+		t.Errorf("unexpected new message %+v", msg)
+	}
+	sizes := fmt.Sprintf(",S=%d,W=%d", msg.Size, msg.Size+5)
+	if !strings.HasSuffix(msg.Key, sizes) {
+		t.Errorf("name %s does not end with %s", msg.Key, sizes)
+	}
+	index, err := md.ReadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index) != 2 || index[0].Key != msg.Key || index[0].Subject != "one" || index[0].From != "sender@example.org" {
+		t.Errorf("unexpected index %+v", index)
+	}
+	m, err := msg.Mail()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.From != "sender@example.org" || len(m.Rcpts) != 1 || m.Rcpts[0] != "rcpt@example.net" {
+		t.Errorf("wrong envelope %q %q", m.From, m.Rcpts)
+	}
+	m.Close()
+
+	if err := msg.AddFlags(FlagSeen + FlagReplied + FlagSeen); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Dir != "cur" || msg.Flags != "RS" || !strings.HasSuffix(msg.Path(), ":2,RS") {
+		t.Errorf("flags not set: %+v", msg)
+	}
+	if err := msg.RemoveFlags(FlagReplied); err != nil {
+		t.Fatal(err)
+	}
+	if err := messages[1].MoveToCur(); err != nil {
+		t.Fatal(err)
+	}
+	if err := messages[1].AddFlags(FlagTrashed); err != nil {
+		t.Fatal(err)
+	}
+	if err := messages[0].SetFlags("x!"); err == nil {
+		t.Error("invalid flag accepted")
+	}
+
+	n, err := md.Expunge()
+	if err != nil || n != 1 {
+		t.Fatalf("expunged %d messages: %v", n, err)
+	}
+	messages, err = md.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].Dir != "cur" || messages[0].Flags != FlagSeen {
+		t.Errorf("unexpected messages after expunge: %+v", messages)
+	}
+}
+
+func TestMaildirCleanTmp(t *testing.T) {
+	dir := testDir(t)
+	md, err := NewMaildir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a failed write leaves nothing behind
+	if _, _, err := md.StoreTmp(&errReader{errors.New("broken")}); err == nil {
+		t.Error("StoreTmp ignored the read error")
+	}
+	if files, _ := ioutil.ReadDir(dir + "/tmp"); len(files) != 0 {
+		t.Errorf("partial file left in tmp")
+	}
+
+	old := time.Now().Add(-DefaultTmpMaxAge - time.Hour)
+	for _, name := range []string{"/tmp/old", "/tmp/recent"} {
+		if err := ioutil.WriteFile(dir+name, []byte("partial"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(dir+"/tmp/old", old, old); err != nil {
+		t.Fatal(err)
+	}
+	n, err := md.CleanTmp(0)
+	if err != nil || n != 1 {
+		t.Fatalf("removed %d files: %v", n, err)
+	}
+	if _, err := os.Stat(dir + "/tmp/recent"); err != nil {
+		t.Errorf("recent file was removed: %s", err)
+	}
+}
+
+var uniqueNameRE = regexp.MustCompile(`^(\d+)\.M(\d+)P(\d+)Q(\d+)R([0-9a-f]{16})(I[0-9a-f]+V[0-9a-f]+)?\.(.+),S=(\d+),W=(\d+)$`)
+
+func TestMaildirUniqueNames(t *testing.T) {
+	dir := testDir(t)
+	md, err := NewMaildir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// three bare line feeds and one CRLF
+	msg := "Subject: names\n\nbody\r\nend\n"
+	for i := 0; i < 20; i++ {
+		if code := deliverTestMail(t, md, "rcpt@example.net", msg); code != CodeOk {
+			t.Fatalf("delivery %d failed with %d", i, code)
+		}
+	}
+	files, err := ioutil.ReadDir(dir + "/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 20 {
+		t.Fatalf("expected 20 distinct names, got %d", len(files))
+	}
+	hostname, _ := maildirHostname()
+	seen := make(map[string]bool)
+	for _, fi := range files {
+		parts := uniqueNameRE.FindStringSubmatch(fi.Name())
+		if parts == nil {
+			t.Errorf("%s is not a unique name", fi.Name())
+			continue
+		}
+		if parts[3] != strconv.Itoa(os.Getpid()) {
+			t.Errorf("%s: P is not the pid", fi.Name())
+		}
+		if seen[parts[4]] {
+			t.Errorf("%s: Q is used twice", fi.Name())
+		}
+		seen[parts[4]] = true
+		if _, _, ok := fileInode(fi); ok && parts[6] == "" {
+			t.Errorf("%s: inode and device are missing", fi.Name())
+		}
+		if parts[7] != hostname {
+			t.Errorf("%s: host is not %s", fi.Name(), hostname)
+		}
+		if parts[8] != strconv.FormatInt(fi.Size(), 10) {
+			t.Errorf("%s: S is not the size %d", fi.Name(), fi.Size())
+		}
+		if parts[9] != strconv.FormatInt(fi.Size()+3, 10) {
+			t.Errorf("%s: W is not the size with CRLF %d", fi.Name(), fi.Size()+3)
+		}
+	}
+}
+
+func TestMaildirDeliveryFailure(t *testing.T) {
+	dir := testDir(t)
+	md, err := NewMaildir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syncDir(dir + "/new"); err != nil {
+		t.Errorf("syncing new failed: %s", err)
+	}
+	// the rename into new fails if it is not a directory
+	if err := os.Remove(dir + "/new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/new", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncDir(dir + "/missing"); err == nil {
+		t.Error("syncing a missing directory succeeded")
+	}
+	if code := deliverTestMail(t, md, "rcpt@example.net", "Subject: fail\n\nbody\n"); code != CodeAborted {
+		t.Errorf("failed rename returned %d", code)
+	}
+	if files, _ := ioutil.ReadDir(dir + "/tmp"); len(files) != 0 {
+		t.Errorf("undelivered file left in tmp")
+	}
+}
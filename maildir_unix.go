@@ -0,0 +1,18 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package lmail
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode returns the inode and device number of a file.
+func fileInode(fi os.FileInfo) (ino, dev uint64, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(st.Ino), uint64(st.Dev), true
+}
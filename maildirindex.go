@@ -0,0 +1,88 @@
+package lmail
+
+import (
+	"bufio"
+	"encoding/json"
+	"mime"
+	"os"
+	"time"
+)
+
+// maildirIndexFile is the name of the sidecar index in a Maildir. Maildir
+// readers ignore files they do not know in the Maildir directory.
+const maildirIndexFile = "lmail-index.jsonl"
+
+// MaildirIndexEntry is a line of the sidecar index of a Maildir. The index
+// is a file of JSON objects, one per line, that lets tools find mails
+// without parsing every file. Entries are only appended, mails that were
+// moved, flagged or deleted since keep their entry, use Key to find their
+// current file.
+type MaildirIndexEntry struct {
+	// Unique name of the file, see MaildirMessage.Key.
+	Key       string    `json:"key"`
+	QueueID   string    `json:"queue_id"`
+	From      string    `json:"from"`
+	Rcpts     []string  `json:"rcpts"`
+	MessageID string    `json:"message_id,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	Delivered time.Time `json:"delivered"`
+}
+
+// appendIndex adds the mail delivered as name to the index.
+func (m *Maildir) appendIndex(name string, mail *Mail) error {
+	key, _ := parseMaildirName(name)
+	entry := MaildirIndexEntry{
+		Key:       key,
+		QueueID:   mail.QueueID,
+		From:      mail.From,
+		Rcpts:     mail.Rcpts,
+		Delivered: time.Now(),
+	}
+	if msg, err := mail.MimeMessage(); err == nil {
+		entry.MessageID = msg.Header.Get("Message-Id")
+		entry.Subject = msg.Header.Get("Subject")
+		decoder := &mime.WordDecoder{}
+		if subject, err := decoder.DecodeHeader(entry.Subject); err == nil {
+			entry.Subject = subject
+		}
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(m.directory+"/"+maildirIndexFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, MaildirCreateMode)
+	if err != nil {
+		return err
+	}
+	// a single write keeps lines of concurrent deliveries apart
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ReadIndex returns the entries of the sidecar index in the order the mails
+// were delivered. A Maildir without index has no entries.
+func (m *Maildir) ReadIndex() ([]MaildirIndexEntry, error) {
+	f, err := os.Open(m.directory + "/" + maildirIndexFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []MaildirIndexEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry MaildirIndexEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// a line cut off by a crash, the rest is still good
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,223 @@
+package lmail
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Maildir info flags as defined in http://cr.yp.to/proto/maildir.html.
+// Flags can be combined, e.g. FlagSeen+FlagReplied.
+const (
+	FlagDraft   = "D"
+	FlagFlagged = "F"
+	FlagPassed  = "P"
+	FlagReplied = "R"
+	FlagSeen    = "S"
+	FlagTrashed = "T"
+)
+
+// MaildirMessage is a message stored in a Maildir.
+type MaildirMessage struct {
+	// Unique name of the message, the file name without the info.
+	Key string
+	// "new" for messages that were not seen by a reader yet, "cur"
+	// otherwise.
+	Dir string
+	// Info flags of the message in ASCII order.
+	Flags   string
+	Size    int64
+	ModTime time.Time
+
+	maildir *Maildir
+	name    string // file name
+}
+
+// parseMaildirName splits a file name into the unique name and the flags of
+// experimental ":2," info.
+func parseMaildirName(name string) (key, flags string) {
+	i := strings.IndexByte(name, ':')
+	if i < 0 {
+		return name, ""
+	}
+	key, info := name[:i], name[i+1:]
+	if strings.HasPrefix(info, "2,") {
+		flags = info[2:]
+	}
+	return key, flags
+}
+
+// normalizeFlags sorts the flags and removes duplicates.
+func normalizeFlags(flags string) (string, error) {
+	set := make([]byte, 0, len(flags))
+	for i := 0; i < len(flags); i++ {
+		c := flags[i]
+		if c < 'A' || c > 'z' || (c > 'Z' && c < 'a') {
+			return "", fmt.Errorf("invalid maildir flag %q", c)
+		}
+		if strings.IndexByte(string(set), c) < 0 {
+			set = append(set, c)
+		}
+	}
+	sort.Slice(set, func(i, j int) bool { return set[i] < set[j] })
+	return string(set), nil
+}
+
+// Messages lists the messages in new and cur, each directory ordered by
+// name. Messages of folders are not included, see Folder.
+func (m *Maildir) Messages() ([]*MaildirMessage, error) {
+	var messages []*MaildirMessage
+	for _, dir := range []string{"new", "cur"} {
+		files, err := ioutil.ReadDir(m.directory + "/" + dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range files {
+			if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+				continue
+			}
+			msg := &MaildirMessage{
+				Dir:     dir,
+				Size:    fi.Size(),
+				ModTime: fi.ModTime(),
+				maildir: m,
+				name:    fi.Name(),
+			}
+			msg.Key, msg.Flags = parseMaildirName(fi.Name())
+			messages = append(messages, msg)
+		}
+	}
+	return messages, nil
+}
+
+// Path returns the path of the file of the message.
+func (msg *MaildirMessage) Path() string {
+	return msg.maildir.directory + "/" + msg.Dir + "/" + msg.name
+}
+
+// HasFlag reports whether the message has the flag set.
+func (msg *MaildirMessage) HasFlag(flag string) bool {
+	return flag != "" && strings.Contains(msg.Flags, flag)
+}
+
+// Open opens the file of the message for reading.
+func (msg *MaildirMessage) Open() (io.ReadCloser, error) {
+	return os.Open(msg.Path())
+}
+
+// Mail reads the message into a Mail. From is taken from the Return-Path
+// field, Rcpts from the Delivered-To fields, if the message has them. Call
+// Close on the Mail to release it.
+func (msg *MaildirMessage) Mail() (*Mail, error) {
+	f, err := os.Open(msg.Path())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := &Mail{}
+	m.PutMessage(f)
+	if err := m.Receive(); err != nil {
+		m.Close()
+		return nil, err
+	}
+	parsed, err := m.MimeMessage()
+	if err != nil {
+		// the message is still readable, it has no envelope though
+		return m, nil
+	}
+	if addr, err := mail.ParseAddress(parsed.Header.Get("Return-Path")); err == nil {
+		m.From = addr.Address
+	}
+	for _, v := range parsed.Header["Delivered-To"] {
+		m.Rcpts = append(m.Rcpts, strings.TrimSpace(v))
+	}
+	return m, nil
+}
+
+// rename moves the message to dir with the given flags. Messages in new have
+// no info.
+func (msg *MaildirMessage) rename(dir, flags string) error {
+	name := msg.Key
+	if dir != "new" {
+		name += ":2," + flags
+	}
+	if dir == msg.Dir && name == msg.name {
+		return nil
+	}
+	err := os.Rename(msg.Path(), msg.maildir.directory+"/"+dir+"/"+name)
+	if err != nil {
+		return err
+	}
+	msg.Dir, msg.name, msg.Flags = dir, name, flags
+	return nil
+}
+
+// SetFlags replaces the flags of the message. The message is moved to cur
+// if it is in new.
+func (msg *MaildirMessage) SetFlags(flags string) error {
+	flags, err := normalizeFlags(flags)
+	if err != nil {
+		return err
+	}
+	return msg.rename("cur", flags)
+}
+
+// AddFlags sets the given flags in addition to those of the message.
+func (msg *MaildirMessage) AddFlags(flags string) error {
+	return msg.SetFlags(msg.Flags + flags)
+}
+
+// RemoveFlags clears the given flags.
+func (msg *MaildirMessage) RemoveFlags(flags string) error {
+	kept := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(flags, r) {
+			return -1
+		}
+		return r
+	}, msg.Flags)
+	return msg.SetFlags(kept)
+}
+
+// MoveToCur moves a message from new to cur without changing its flags, as
+// readers do once they have seen the message.
+func (msg *MaildirMessage) MoveToCur() error {
+	return msg.rename("cur", msg.Flags)
+}
+
+// Delete removes the message from the Maildir. If the Maildir has a
+// maildirsize file, the message is subtracted.
+func (msg *MaildirMessage) Delete() error {
+	if err := os.Remove(msg.Path()); err != nil {
+		return err
+	}
+	err := msg.maildir.quotaRoot().appendMaildirSize(-msg.Size, -1)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Expunge deletes all messages that have the FlagTrashed set and returns
+// their number.
+func (m *Maildir) Expunge() (int, error) {
+	messages, err := m.Messages()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, msg := range messages {
+		if !msg.HasFlag(FlagTrashed) {
+			continue
+		}
+		if err := msg.Delete(); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,186 @@
+package lmail
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DefaultMaildirTemplate is the layout of a MaildirStore if it has no
+// Template.
+const DefaultMaildirTemplate = "{domain}/{local}/"
+
+var maildirFolderKey = &contextKey{"maildir-folder"}
+
+// WithMaildirFolder returns a context that makes a MaildirStore deliver into
+// the given Maildir++ folder, unless its Filter chooses another one. Handlers
+// and middlewares that pass the mail on to a MaildirStore use it to sort
+// mails, e.g. into "Spam".
+func WithMaildirFolder(ctx context.Context, folder string) context.Context {
+	return context.WithValue(ctx, maildirFolderKey, folder)
+}
+
+// MaildirStore is a mail Handler that delivers to a Maildir per recipient.
+// The Maildirs are kept below a root directory, the path of a recipient's
+// Maildir is given by a template. Maildirs and folders are created with
+// MaildirCreateMode when they get their first mail.
+//
+// A mail with several recipients is delivered to each of them. If one
+// delivery fails its error is returned, even if the mail was delivered to
+// other recipients before. SMTP has a single reply to DATA, so a client
+// that retries after a temporary failure delivers the mail to these
+// recipients twice.
+type MaildirStore struct {
+	// Template of the path of a Maildir relative to the root. {local} is
+	// replaced by the local part of the recipient, {domain} by its domain
+	// and {rcpt} by the whole address, all in lower case. If empty
+	// DefaultMaildirTemplate is used.
+	Template string
+
+	// Filter chooses the Maildir++ folder a mail is delivered to, e.g.
+	// "Spam" or "Archive.2024". If it is nil or returns an empty string,
+	// the folder from the context or the inbox is used.
+	Filter func(m *Mail, rcpt string) string
+
+	// ReturnPath and DeliveredTo are set on the Maildirs of the store.
+	ReturnPath  bool
+	DeliveredTo bool
+
+	// Index is set on every Maildir of the store.
+	Index bool
+
+	// Quota and QuotaPolicy are set on every Maildir of the store.
+	Quota       Quota
+	QuotaPolicy QuotaPolicy
+
+	root    string
+	mu      sync.Mutex
+	folders map[string]*Maildir // Maildirs by path, created already
+}
+
+// NewMaildirStore returns a store below root using template for the paths
+// of the Maildirs. Nothing is created until the first mail arrives.
+func NewMaildirStore(root, template string) *MaildirStore {
+	return &MaildirStore{
+		Template: template,
+		root:     root,
+		folders:  make(map[string]*Maildir),
+	}
+}
+
+// expandRcptTemplate replaces {local}, {domain} and {rcpt} in template with
+// the parts of the recipient address in lower case, so all spellings of an
+// address share a mailbox. Addresses that would leave the directory of the
+// template are rejected.
+func expandRcptTemplate(template, rcpt string) (string, error) {
+	rcpt = strings.ToLower(rcpt)
+	local, domain := rcpt, ""
+	if i := strings.LastIndex(rcpt, "@"); i >= 0 {
+		local, domain = rcpt[:i], rcpt[i+1:]
+	}
+	for _, part := range []string{local, domain} {
+		if strings.ContainsAny(part, "/\\\x00") || part == "." || part == ".." {
+			return "", &SMTPError{CodeNotTaken, "5.1.3", "Bad destination mailbox address"}
+		}
+	}
+	return strings.NewReplacer("{local}", local, "{domain}", domain, "{rcpt}", rcpt).Replace(template), nil
+}
+
+// maildirPath returns the directory of the Maildir of rcpt.
+func (s *MaildirStore) maildirPath(rcpt string) (string, error) {
+	template := s.Template
+	if template == "" {
+		template = DefaultMaildirTemplate
+	}
+	dir, err := expandRcptTemplate(template, rcpt)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, dir), nil
+}
+
+func (s *MaildirStore) newMaildir(dir string) *Maildir {
+	return &Maildir{
+		directory:   dir,
+		ReturnPath:  s.ReturnPath,
+		DeliveredTo: s.DeliveredTo,
+		Index:       s.Index,
+		Quota:       s.Quota,
+		QuotaPolicy: s.QuotaPolicy,
+	}
+}
+
+// maildir returns the folder of the Maildir at dir and creates it if needed.
+// Creating the directories is idempotent, it is done without holding the
+// lock so deliveries to other Maildirs are not held up by the file system.
+func (s *MaildirStore) maildir(dir, folder string) (*Maildir, error) {
+	key := dir + "/." + folder
+	s.mu.Lock()
+	md, ok := s.folders[key]
+	s.mu.Unlock()
+	if ok {
+		return md, nil
+	}
+	inbox := s.newMaildir(dir)
+	if err := inbox.create(); err != nil {
+		return nil, err
+	}
+	md, err := inbox.Folder(folder)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cached, ok := s.folders[key]; ok {
+		return cached, nil
+	}
+	s.folders[key] = md
+	return md, nil
+}
+
+// HandleMail delivers the mail to the Maildirs of its recipients.
+func (s *MaildirStore) HandleMail(m *Mail) (int, error) {
+	return s.HandleMailContext(m.Context(), m)
+}
+
+// HandleMailContext is HandleMail with a context that may choose the folder,
+// see WithMaildirFolder.
+func (s *MaildirStore) HandleMailContext(ctx context.Context, m *Mail) (int, error) {
+	folder, _ := ctx.Value(maildirFolderKey).(string)
+	for _, rcpt := range m.Rcpts {
+		dir, err := s.maildirPath(rcpt)
+		if err != nil {
+			return CodeNotTaken, err
+		}
+		f := folder
+		if s.Filter != nil {
+			if name := s.Filter(m, rcpt); name != "" {
+				f = name
+			}
+		}
+		md, err := s.maildir(dir, f)
+		if err != nil {
+			log.Printf("Maildir: could not open %s for %s: %s", dir, rcpt, err)
+			return CodeAborted, &SMTPError{CodeAborted, "4.3.0", "Could not open mailbox"}
+		}
+		rcptMail := m.Clone()
+		rcptMail.Rcpts = []string{rcpt}
+		if code, err := md.HandleMailContext(ctx, rcptMail); err != nil {
+			return code, err
+		}
+	}
+	return CodeOk, nil
+}
+
+// CheckRcpt implements RcptChecker, it checks whether a mail of the given
+// size fits into the quota of the recipient's Maildir. The Maildir is not
+// created for the check.
+func (s *MaildirStore) CheckRcpt(ctx context.Context, from, rcpt string, size int64) error {
+	dir, err := s.maildirPath(rcpt)
+	if err != nil {
+		return err
+	}
+	return s.newMaildir(dir).checkQuota(size)
+}
@@ -0,0 +1,82 @@
+package lmail
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExpandRcptTemplate(t *testing.T) {
+	tests := []struct {
+		template, rcpt, want string
+	}{
+		{"{domain}/{local}/", "Rcpt@Example.NET", "example.net/rcpt/"},
+		{"{rcpt}", "Rcpt@Example.NET", "rcpt@example.net"},
+		{"users/{local}.mbox", "postmaster", "users/postmaster.mbox"},
+		{"{domain}/{local}/", "a.b@example.net", "example.net/a.b/"},
+	}
+	for _, test := range tests {
+		got, err := expandRcptTemplate(test.template, test.rcpt)
+		if err != nil || got != test.want {
+			t.Errorf("%s with %s: got %q %v, want %q", test.template, test.rcpt, got, err, test.want)
+		}
+	}
+	for _, rcpt := range []string{"../x@example.net", "a/b@example.net", "..@example.net", "x@..", "x@a\\b"} {
+		if got, err := expandRcptTemplate(DefaultMaildirTemplate, rcpt); err == nil {
+			t.Errorf("%s expanded to %q", rcpt, got)
+		}
+	}
+}
+
+// countNew returns the number of mails in the new directory of dir.
+func countNew(t *testing.T, dir string) int {
+	files, err := ioutil.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		t.Errorf("reading %s: %s", dir, err)
+	}
+	return len(files)
+}
+
+func TestMaildirStoreFolders(t *testing.T) {
+	dir := testDir(t)
+	store := NewMaildirStore(dir, "")
+	store.Filter = func(m *Mail, rcpt string) string {
+		if strings.HasPrefix(rcpt, "archive") {
+			return "Archive/2024"
+		}
+		return ""
+	}
+	msg := "Subject: folders\n\nbody\n"
+	if code := deliverTestMail(t, store, "Rcpt@Example.net", msg); code != CodeOk {
+		t.Fatalf("inbox delivery failed with %d", code)
+	}
+	if code := deliverTestMail(t, store, "archive@example.net", msg); code != CodeOk {
+		t.Fatalf("filtered delivery failed with %d", code)
+	}
+	m := newTestMail(strings.NewReader(msg), "rcpt@example.net", "archive@example.net")
+	defer m.Close()
+	if code, err := store.HandleMailContext(WithMaildirFolder(context.Background(), "Spam"), m); code != CodeOk {
+		t.Fatalf("delivery with folder failed with %d %v", code, err)
+	}
+
+	rcpt := filepath.Join(dir, "example.net", "rcpt")
+	archive := filepath.Join(dir, "example.net", "archive")
+	for path, want := range map[string]int{
+		rcpt:                                    1,
+		filepath.Join(rcpt, ".Spam"):            1,
+		archive:                                 0,
+		filepath.Join(archive, ".Archive.2024"): 2,
+	} {
+		if n := countNew(t, path); n != want {
+			t.Errorf("%s: expected %d mails, got %d", path, want, n)
+		}
+	}
+	for _, folder := range []string{filepath.Join(rcpt, ".Spam"), filepath.Join(archive, ".Archive.2024")} {
+		if _, err := os.Stat(filepath.Join(folder, "maildirfolder")); err != nil {
+			t.Errorf("folder is not marked: %s", err)
+		}
+	}
+}
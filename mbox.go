@@ -0,0 +1,227 @@
+package lmail
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// DefaultMboxLockTimeout is how long Mbox waits for the locks of a file if
+// its LockTimeout is zero.
+const DefaultMboxLockTimeout = 30 * time.Second
+
+// dot lock files older than this are left over from a crashed writer
+const staleDotLock = 5 * time.Minute
+
+// interval in which a held lock is tried again
+const mboxLockRetry = 100 * time.Millisecond
+
+var errLocked = errors.New("mbox is locked")
+
+// Mbox is a mail Handler that appends mails to mbox files in the mboxrd
+// format: every mail starts with a "From sender date" line and lines of the
+// mail that start with any number of ">" followed by "From " are escaped
+// with another ">".
+//
+// Files are locked with fcntl, where the system supports it, and with a dot
+// lock file, so that mail readers using either see complete mails only. If
+// writing fails, the file is truncated to its original size.
+//
+// A mail with several recipients is appended to each of their files. If one
+// of them fails a 451 is returned, even if the mail was appended to other
+// files before, and the retry of the client appends it there again.
+type Mbox struct {
+	// Path of the mbox file, {local}, {domain} and {rcpt} are replaced as
+	// in MaildirStore.Template to give each recipient an own file.
+	Path string
+	// LockTimeout is how long to wait for the locks of a file, if zero
+	// DefaultMboxLockTimeout is used.
+	LockTimeout time.Duration
+}
+
+// NewMbox returns an Mbox handler that appends to the file at path, which
+// may be a template.
+func NewMbox(path string) *Mbox {
+	return &Mbox{Path: path}
+}
+
+// HandleMail appends the mail to the mbox files of its recipients.
+func (mb *Mbox) HandleMail(m *Mail) (int, error) {
+	return mb.HandleMailContext(m.Context(), m)
+}
+
+// HandleMailContext is HandleMail with a context, if it is done before a mail
+// is written completely the mbox file is restored.
+func (mb *Mbox) HandleMailContext(ctx context.Context, m *Mail) (int, error) {
+	written := make(map[string]bool)
+	for _, rcpt := range m.Rcpts {
+		path, err := expandRcptTemplate(mb.Path, rcpt)
+		if err != nil {
+			return CodeNotTaken, err
+		}
+		// recipients that share a file get the mail once
+		if written[path] {
+			continue
+		}
+		if err := mb.deliver(ctx, path, m); err != nil {
+			log.Printf("Mbox: could not deliver %s to %s: %s", m.QueueID, path, err)
+			return CodeAborted, &SMTPError{CodeAborted, "4.3.0", "Could not deliver message"}
+		}
+		written[path] = true
+	}
+	return CodeOk, nil
+}
+
+// deliver appends the mail to the file at path.
+func (mb *Mbox) deliver(ctx context.Context, path string, m *Mail) (err error) {
+	f, unlock, err := mb.lock(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if terr := f.Truncate(size); terr != nil {
+				log.Printf("Mbox: could not truncate %s: %s", path, terr)
+			}
+		}
+	}()
+	w := bufio.NewWriter(f)
+	if err = writeMboxrd(w, m.From, time.Now(), &contextReader{ctx, m.RawReader()}); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// lock opens the file at path and takes its locks. The returned function
+// releases the locks and closes the file.
+func (mb *Mbox) lock(ctx context.Context, path string) (*os.File, func(), error) {
+	timeout := time.NewTimer(orDefault(mb.LockTimeout, DefaultMboxLockTimeout))
+	defer timeout.Stop()
+	retry := time.NewTimer(mboxLockRetry)
+	defer retry.Stop()
+	dotLock := path + ".lock"
+	for {
+		err := takeDotLock(dotLock)
+		if err == nil {
+			break
+		}
+		if err != errLocked {
+			return nil, nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-timeout.C:
+			return nil, nil, fmt.Errorf("timeout waiting for %s", dotLock)
+		case <-retry.C:
+			retry.Reset(mboxLockRetry)
+		}
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		os.Remove(dotLock)
+		return nil, nil, err
+	}
+	for {
+		err = lockFile(f)
+		if err == nil {
+			break
+		}
+		if err != errLocked {
+			f.Close()
+			os.Remove(dotLock)
+			return nil, nil, err
+		}
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-timeout.C:
+			err = fmt.Errorf("timeout waiting for the lock of %s", path)
+		case <-retry.C:
+			retry.Reset(mboxLockRetry)
+			continue
+		}
+		f.Close()
+		os.Remove(dotLock)
+		return nil, nil, err
+	}
+	return f, func() {
+		unlockFile(f)
+		f.Close()
+		os.Remove(dotLock)
+	}, nil
+}
+
+// takeDotLock creates the lock file, stale lock files are removed. It
+// returns errLocked if another process holds the lock.
+func takeDotLock(name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err == nil {
+		fmt.Fprintf(f, "%d\n", os.Getpid())
+		return f.Close()
+	}
+	if !os.IsExist(err) {
+		return err
+	}
+	if fi, err := os.Stat(name); err == nil && time.Since(fi.ModTime()) > staleDotLock {
+		os.Remove(name)
+	}
+	return errLocked
+}
+
+var mboxFrom = []byte("From ")
+
+// writeMboxrd writes a mail in mboxrd format. The mail ends with an empty
+// line that separates it from the next one.
+func writeMboxrd(w *bufio.Writer, from string, date time.Time, r io.Reader) error {
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+	if _, err := fmt.Fprintf(w, "From %s %s\n", from, date.UTC().Format(time.ANSIC)); err != nil {
+		return err
+	}
+	br := bufio.NewReader(r)
+	atStart := true
+	last := byte('\n')
+	for {
+		line, err := br.ReadSlice('\n')
+		if len(line) > 0 {
+			if atStart && bytes.HasPrefix(bytes.TrimLeft(line, ">"), mboxFrom) {
+				if err := w.WriteByte('>'); err != nil {
+					return err
+				}
+			}
+			if _, err := w.Write(line); err != nil {
+				return err
+			}
+			last = line[len(line)-1]
+			atStart = last == '\n'
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+	if last != '\n' {
+		if err := w.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	return w.WriteByte('\n')
+}
@@ -0,0 +1,75 @@
+package lmail
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMbox(t *testing.T) {
+	dir := testDir(t)
+	mb := NewMbox(dir + "/{local}.mbox")
+	msg := "Subject: from\n\nFrom here\n>From there\nno From\n"
+	if code := deliverTestMail(t, mb, "rcpt@example.net", msg); code != CodeOk {
+		t.Fatalf("delivery failed with %d", code)
+	}
+	if code := deliverTestMail(t, mb, "rcpt@example.net", "Subject: second\n\nno newline"); code != CodeOk {
+		t.Fatalf("delivery failed with %d", code)
+	}
+	b, err := ioutil.ReadFile(dir + "/rcpt.mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(b), "\n")
+	if !strings.HasPrefix(lines[0], "From sender@example.org ") {
+		t.Errorf("wrong separator %q", lines[0])
+	}
+	want := []string{"Subject: from", "", ">From here", ">>From there", "no From", ""}
+	for i, line := range want {
+		if lines[i+1] != line {
+			t.Errorf("line %d: expected %q, got %q", i+1, line, lines[i+1])
+		}
+	}
+	if !strings.HasPrefix(lines[7], "From sender@example.org ") || !strings.HasSuffix(string(b), "no newline\n\n") {
+		t.Errorf("second mail not appended correctly: %q", b)
+	}
+	if _, err := os.Stat(dir + "/rcpt.mbox.lock"); !os.IsNotExist(err) {
+		t.Error("dot lock was not removed")
+	}
+
+	// a mail that breaks off is removed again
+	m := newTestMail(io.MultiReader(strings.NewReader("Subject: broken\n\n"), &errReader{errors.New("broken")}), "rcpt@example.net")
+	defer m.Close()
+	if code, _ := mb.HandleMail(m); code != CodeAborted {
+		t.Errorf("broken mail returned %d", code)
+	}
+	if after, _ := ioutil.ReadFile(dir + "/rcpt.mbox"); string(after) != string(b) {
+		t.Errorf("mbox was not truncated: %q", after)
+	}
+}
+
+func TestMboxLockRetry(t *testing.T) {
+	dir := testDir(t)
+	mb := NewMbox(dir + "/rcpt.mbox")
+	mb.LockTimeout = 150 * time.Millisecond
+	lock := dir + "/rcpt.mbox.lock"
+	if err := ioutil.WriteFile(lock, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := deliverTestMail(t, mb, "rcpt@example.net", "Subject: locked\n\nbody\n"); code != CodeAborted {
+		t.Errorf("delivery to a locked mbox returned %d", code)
+	}
+	// the lock is taken once its holder releases it
+	mb.LockTimeout = 0
+	time.AfterFunc(350*time.Millisecond, func() { os.Remove(lock) })
+	if code := deliverTestMail(t, mb, "rcpt@example.net", "Subject: retried\n\nbody\n"); code != CodeOk {
+		t.Errorf("delivery after the lock was released returned %d", code)
+	}
+	if b, _ := ioutil.ReadFile(dir + "/rcpt.mbox"); !strings.Contains(string(b), "Subject: retried\n") {
+		t.Errorf("mail was not appended: %q", b)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package lmail
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an fcntl write lock on the whole file. It returns errLocked
+// if another process holds a lock.
+func lockFile(f *os.File) error {
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart}
+	err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lock)
+	if err == syscall.EAGAIN || err == syscall.EACCES {
+		return errLocked
+	}
+	return err
+}
+
+func unlockFile(f *os.File) error {
+	lock := syscall.Flock_t{Type: syscall.F_UNLCK, Whence: io.SeekStart}
+	return syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lock)
+}
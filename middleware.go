@@ -0,0 +1,134 @@
+package lmail
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// HandlerFunc is an adapter to use ordinary functions as Handlers.
+type HandlerFunc func(*Mail) (int, error)
+
+// HandleMail calls f(m).
+func (f HandlerFunc) HandleMail(m *Mail) (int, error) {
+	return f(m)
+}
+
+// ContextHandlerFunc is an adapter to use ordinary functions as
+// ContextHandlers.
+type ContextHandlerFunc func(context.Context, *Mail) (int, error)
+
+// HandleMail calls f with the context of m.
+func (f ContextHandlerFunc) HandleMail(m *Mail) (int, error) {
+	return f(m.Context(), m)
+}
+
+// HandleMailContext calls f(ctx, m).
+func (f ContextHandlerFunc) HandleMailContext(ctx context.Context, m *Mail) (int, error) {
+	return f(ctx, m)
+}
+
+// Middleware wraps a Handler to add behaviour before or after it.
+type Middleware func(Handler) Handler
+
+// Chain wraps h with the given middlewares. The first middleware is the
+// outermost, so Chain(h, a, b) handles a mail in a, then b, then h. If h is
+// a RcptChecker, so is the returned Handler.
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	checker, _ := h.(RcptChecker)
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	if _, ok := h.(RcptChecker); checker != nil && !ok {
+		h = &chained{h, checker}
+	}
+	return h
+}
+
+// chained keeps the RcptChecker of the innermost Handler of a Chain.
+type chained struct {
+	Handler
+	checker RcptChecker
+}
+
+func (c *chained) HandleMailContext(ctx context.Context, m *Mail) (int, error) {
+	return handleMail(ctx, c.Handler, m)
+}
+
+func (c *chained) CheckRcpt(ctx context.Context, from, rcpt string, size int64) error {
+	return c.checker.CheckRcpt(ctx, from, rcpt, size)
+}
+
+func loggerf(logger *log.Logger, format string, args ...interface{}) {
+	if logger != nil {
+		logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// Recover returns a middleware that recovers from panics in the wrapped
+// Handler. The panic and its stack trace are logged to logger, or the
+// standard logger if nil, and the client receives a 451.
+func Recover(logger *log.Logger) Middleware {
+	return func(next Handler) Handler {
+		return ContextHandlerFunc(func(ctx context.Context, m *Mail) (code int, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					loggerf(logger, "Handler panic: %v\n%s", r, debug.Stack())
+					code = CodeAborted
+					err = &SMTPError{CodeAborted, "4.3.0", "Internal error"}
+				}
+			}()
+			return handleMail(ctx, next, m)
+		})
+	}
+}
+
+// Timing returns a middleware that logs how long the wrapped Handler took
+// and what it returned to logger, or the standard logger if nil.
+func Timing(logger *log.Logger) Middleware {
+	return func(next Handler) Handler {
+		return ContextHandlerFunc(func(ctx context.Context, m *Mail) (int, error) {
+			start := time.Now()
+			code, err := handleMail(ctx, next, m)
+			loggerf(logger, "Handled mail from %s to %v in %s: %d %v",
+				m.From, m.Rcpts, time.Since(start), code, err)
+			return code, err
+		})
+	}
+}
+
+// MaxSize returns a middleware that rejects mails larger than max bytes with
+// a 552 before the wrapped Handler is called.
+func MaxSize(max int64) Middleware {
+	return func(next Handler) Handler {
+		return ContextHandlerFunc(func(ctx context.Context, m *Mail) (int, error) {
+			r := io.LimitReader(&contextReader{ctx, m.RawReader()}, max+1)
+			n, err := io.Copy(ioutil.Discard, r)
+			if err != nil {
+				return CodeAborted, &SMTPError{CodeAborted, "4.3.0", "Could not read message"}
+			}
+			if n > max {
+				return CodeMailAborted, &SMTPError{CodeMailAborted, "5.3.4", "Message too big"}
+			}
+			return handleMail(ctx, next, m)
+		})
+	}
+}
+
+// FullyReceived is a middleware that calls the wrapped Handler only after the
+// whole message has been received. Handlers that are not able to process a
+// message while it streams in, or that must not see incomplete messages,
+// can be wrapped with it.
+func FullyReceived(next Handler) Handler {
+	return ContextHandlerFunc(func(ctx context.Context, m *Mail) (int, error) {
+		if err := m.Receive(); err != nil {
+			return CodeAborted, &SMTPError{CodeAborted, "4.3.0", "Could not receive message"}
+		}
+		return handleMail(ctx, next, m)
+	})
+}
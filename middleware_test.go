@@ -0,0 +1,108 @@
+package lmail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+)
+
+// checkReply checks that a Handler replied with code and, if code is not
+// CodeOk, an SMTPError with the same code.
+func checkReply(t *testing.T, name string, code int, err error, want int) {
+	t.Helper()
+	if code != want {
+		t.Errorf("%s: got %d %v, want %d", name, code, err, want)
+		return
+	}
+	var serr *SMTPError
+	if want != CodeOk && (!errors.As(err, &serr) || serr.Code != want) {
+		t.Errorf("%s: got error %v, want a %d SMTPError", name, err, want)
+	}
+}
+
+type rcptHandler struct {
+	HandlerFunc
+}
+
+func (h rcptHandler) CheckRcpt(ctx context.Context, from, rcpt string, size int64) error {
+	if rcpt != "rcpt@example.net" {
+		return &SMTPError{CodeNotTaken, "5.1.1", "Unknown user"}
+	}
+	return nil
+}
+
+func TestChain(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(m *Mail) (int, error) {
+				calls = append(calls, name)
+				return next.HandleMail(m)
+			})
+		}
+	}
+	h := rcptHandler{func(m *Mail) (int, error) {
+		calls = append(calls, "h")
+		return CodeOk, nil
+	}}
+	chain := Chain(h, trace("a"), trace("b"))
+	m := newTestMail(strings.NewReader("Subject: chain\n\nbody\n"), "rcpt@example.net")
+	defer m.Close()
+	code, err := handleMail(context.Background(), chain, m)
+	checkReply(t, "chain", code, err, CodeOk)
+	if strings.Join(calls, ",") != "a,b,h" {
+		t.Errorf("handlers called in order %v", calls)
+	}
+	checker, ok := chain.(RcptChecker)
+	if !ok {
+		t.Fatal("Chain lost the RcptChecker")
+	}
+	if err := checker.CheckRcpt(context.Background(), "", "rcpt@example.net", 0); err != nil {
+		t.Errorf("known recipient rejected: %s", err)
+	}
+	if err := checker.CheckRcpt(context.Background(), "", "other@example.net", 0); err == nil {
+		t.Error("unknown recipient accepted")
+	}
+}
+
+func TestMiddlewares(t *testing.T) {
+	var logs bytes.Buffer
+	logger := log.New(&logs, "", 0)
+	ok := HandlerFunc(func(m *Mail) (int, error) { return CodeOk, nil })
+	panics := HandlerFunc(func(m *Mail) (int, error) { panic("boom") })
+	body := "Subject: size\n\n" + strings.Repeat("x", 100) + "\n"
+	broken := func() io.Reader {
+		return io.MultiReader(strings.NewReader(body), &errReader{errors.New("broken")})
+	}
+	tests := []struct {
+		name    string
+		handler Handler
+		msg     io.Reader
+		want    int
+	}{
+		{"HandlerFunc", ok, strings.NewReader(body), CodeOk},
+		{"Recover", Recover(logger)(panics), strings.NewReader(body), CodeAborted},
+		{"Timing", Timing(logger)(ok), strings.NewReader(body), CodeOk},
+		{"MaxSize", MaxSize(1000)(ok), strings.NewReader(body), CodeOk},
+		{"MaxSize too big", MaxSize(10)(ok), strings.NewReader(body), CodeMailAborted},
+		{"MaxSize broken", MaxSize(1000)(ok), broken(), CodeAborted},
+		{"FullyReceived", FullyReceived(ok), strings.NewReader(body), CodeOk},
+		{"FullyReceived broken", FullyReceived(ok), broken(), CodeAborted},
+	}
+	for _, test := range tests {
+		m := newTestMail(test.msg, "rcpt@example.net")
+		code, err := handleMail(context.Background(), test.handler, m)
+		m.Close()
+		checkReply(t, test.name, code, err, test.want)
+	}
+	if !strings.Contains(logs.String(), "boom") {
+		t.Errorf("panic was not logged: %q", logs.String())
+	}
+	if !strings.Contains(logs.String(), "Handled mail from sender@example.org") {
+		t.Errorf("timing was not logged: %q", logs.String())
+	}
+}
@@ -0,0 +1,217 @@
+package lmail
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+	"unicode/utf8"
+)
+
+// MimePart is a part of a MIME message. The top level message is a part as
+// well. Reading from a MimePart returns its body with the transfer encoding
+// removed and, for text parts, converted to UTF-8. Multipart parts have no
+// body of their own, their children are returned by the following calls to
+// MimeReader.NextPart.
+type MimePart struct {
+	Header textproto.MIMEHeader
+	// Media type in lower case, "text/plain" if the part does not name one.
+	ContentType string
+	// Parameters of the Content-Type field
+	Params map[string]string
+	// Charset of a text part as given in the message. The body is only
+	// converted to UTF-8 if the charset is known.
+	Charset string
+	// "inline", "attachment" or empty if the part has no
+	// Content-Disposition.
+	Disposition string
+	// Decoded file name from Content-Disposition or Content-Type.
+	Filename string
+	// Nesting level of the part, the top level message is 0.
+	Depth int
+
+	body io.Reader
+}
+
+// IsMultipart reports whether the part contains other parts.
+func (p *MimePart) IsMultipart() bool {
+	return strings.HasPrefix(p.ContentType, "multipart/")
+}
+
+// IsAttachment reports whether the part is meant to be saved rather than
+// displayed: it is marked as attachment or it carries a file name and is not
+// marked as inline.
+func (p *MimePart) IsAttachment() bool {
+	if p.Disposition == "attachment" {
+		return true
+	}
+	return p.Disposition == "" && p.Filename != ""
+}
+
+// Read reads the decoded body of the part.
+func (p *MimePart) Read(b []byte) (int, error) {
+	return p.body.Read(b)
+}
+
+// MimeReader walks the parts of a MIME message depth first while the message
+// is read. Parts have to be read before the next one is requested, skipped
+// parts are discarded.
+type MimeReader struct {
+	// CharsetReader converts text in charsets other than UTF-8, US-ASCII,
+	// ISO-8859-1 and Windows-1252 to UTF-8. If it is nil or returns an
+	// error, the text is left as it is.
+	CharsetReader func(charset string, input io.Reader) (io.Reader, error)
+
+	// header and body of the top level message until its part is built by
+	// the first call to NextPart, after CharsetReader was set.
+	header  textproto.MIMEHeader
+	body    io.Reader
+	started bool
+	stack   []*multipart.Reader
+}
+
+// MimeReader returns a reader for the MIME parts of the message. It reads
+// from its own RawReader, so it can be used alongside other readers of the
+// message.
+func (m *Mail) MimeReader() (*MimeReader, error) {
+	r := bufio.NewReader(m.RawReader())
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("could not read header: %s", err)
+	}
+	return &MimeReader{header: header, body: r}, nil
+}
+
+// NextPart returns the next part of the message, the top level message is
+// the first. At the end of the message it returns io.EOF.
+func (mr *MimeReader) NextPart() (*MimePart, error) {
+	if !mr.started {
+		mr.started = true
+		p := mr.newPart(mr.header, mr.body, 0)
+		mr.header, mr.body = nil, nil
+		mr.descend(p)
+		return p, nil
+	}
+	for len(mr.stack) > 0 {
+		r := mr.stack[len(mr.stack)-1]
+		raw, err := r.NextRawPart()
+		if err == io.EOF {
+			mr.stack = mr.stack[:len(mr.stack)-1]
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		p := mr.newPart(raw.Header, raw, len(mr.stack))
+		mr.descend(p)
+		return p, nil
+	}
+	return nil, io.EOF
+}
+
+// descend makes the children of a multipart part the next parts.
+func (mr *MimeReader) descend(p *MimePart) {
+	boundary := p.Params["boundary"]
+	if !p.IsMultipart() || boundary == "" {
+		return
+	}
+	mr.stack = append(mr.stack, multipart.NewReader(p.body, boundary))
+	p.body = strings.NewReader("")
+}
+
+func (mr *MimeReader) newPart(header textproto.MIMEHeader, body io.Reader, depth int) *MimePart {
+	p := &MimePart{Header: header, Depth: depth, ContentType: "text/plain"}
+	mediatype, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err == nil {
+		p.ContentType = mediatype
+		p.Params = params
+	}
+	if p.Params == nil {
+		p.Params = make(map[string]string)
+	}
+	decoder := &mime.WordDecoder{CharsetReader: mr.charsetReader}
+	disposition, dparams, err := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if err == nil {
+		p.Disposition = disposition
+		p.Filename = dparams["filename"]
+	}
+	if p.Filename == "" {
+		p.Filename = p.Params["name"]
+	}
+	if name, err := decoder.DecodeHeader(p.Filename); err == nil {
+		p.Filename = name
+	}
+
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	if strings.HasPrefix(p.ContentType, "text/") {
+		p.Charset = p.Params["charset"]
+		if r, err := mr.charsetReader(p.Charset, body); err == nil {
+			body = r
+		}
+	}
+	p.body = body
+	return p
+}
+
+func (mr *MimeReader) charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return input, nil
+	case "iso-8859-1", "latin1", "l1":
+		return &singleByteReader{r: input}, nil
+	case "windows-1252", "cp1252":
+		return &singleByteReader{r: input, table: &windows1252}, nil
+	}
+	if mr.CharsetReader != nil {
+		return mr.CharsetReader(charset, input)
+	}
+	return nil, fmt.Errorf("unknown charset %s", charset)
+}
+
+// windows1252 maps the bytes 0x80 to 0x9f of Windows-1252, the rest of it is
+// identical to ISO-8859-1.
+var windows1252 = [32]rune{
+	'€', '\u0081', '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', '\u008d', 'Ž', '\u008f',
+	'\u0090', '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', '\u009d', 'ž', 'Ÿ',
+}
+
+// singleByteReader converts ISO-8859-1, or Windows-1252 if table is set, to
+// UTF-8.
+type singleByteReader struct {
+	r     io.Reader
+	table *[32]rune
+	out   []byte // converted bytes
+	off   int    // bytes of out that were read already
+	in    [512]byte
+}
+
+func (s *singleByteReader) Read(p []byte) (n int, err error) {
+	if s.off == len(s.out) {
+		s.out, s.off = s.out[:0], 0
+		var m int
+		m, err = s.r.Read(s.in[:])
+		for _, c := range s.in[:m] {
+			r := rune(c)
+			if s.table != nil && c >= 0x80 && c < 0xa0 {
+				r = s.table[c-0x80]
+			}
+			s.out = utf8.AppendRune(s.out, r)
+		}
+	}
+	n = copy(p, s.out[s.off:])
+	s.off += n
+	if s.off < len(s.out) && err == io.EOF {
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,120 @@
+package lmail
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const mimeMessage = `From: sender@example.org
+To: rcpt@example.net
+Subject: parts
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="outer"
+
+preamble
+--outer
+Content-Type: multipart/alternative; boundary="inner"
+
+--inner
+Content-Type: text/plain; charset=iso-8859-1
+Content-Transfer-Encoding: quoted-printable
+
+Gr=FC=DFe
+--inner
+Content-Type: text/html; charset=utf-8
+
+<p>Gr&uuml;&szlig;e</p>
+--inner--
+--outer
+Content-Type: application/octet-stream; name="ignored.bin"
+Content-Disposition: attachment; filename="=?utf-8?q?b=C3=A4r.bin?="
+Content-Transfer-Encoding: base64
+
+aGVsbG8gd29y
+bGQ=
+--outer--
+`
+
+func TestMimeReader(t *testing.T) {
+	m := &Mail{}
+	m.PutMessage(strings.NewReader(mimeMessage))
+	mr, err := m.MimeReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		contentType string
+		depth       int
+		body        string
+		filename    string
+		attachment  bool
+	}{
+		{"multipart/mixed", 0, "", "", false},
+		{"multipart/alternative", 1, "", "", false},
+		{"text/plain", 2, "Grüße", "", false},
+		{"text/html", 2, "<p>Gr&uuml;&szlig;e</p>", "", false},
+		{"application/octet-stream", 1, "hello world", "bär.bin", true},
+	}
+	// read the raw message concurrently
+	done := make(chan error)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, m.RawReader())
+		done <- err
+	}()
+	for i, w := range want {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %s", i, err)
+		}
+		body, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatalf("part %d: %s", i, err)
+		}
+		if p.ContentType != w.contentType || p.Depth != w.depth || string(body) != w.body ||
+			p.Filename != w.filename || p.IsAttachment() != w.attachment {
+			t.Errorf("part %d: got %s depth %d body %q file %q attachment %v", i,
+				p.ContentType, p.Depth, body, p.Filename, p.IsAttachment())
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Fatalf("expected io.EOF after the last part, got %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMimeReaderSinglePartCharset(t *testing.T) {
+	m := &Mail{}
+	m.PutMessage(strings.NewReader("Subject: single\nContent-Type: text/plain; charset=koi8-r;\n name=\"=?koi8-r?q?x?=\"\n\nbody\n"))
+	defer m.Close()
+	mr, err := m.MimeReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var called []string
+	mr.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		called = append(called, charset)
+		b, err := ioutil.ReadAll(input)
+		return strings.NewReader(strings.ToUpper(string(b))), err
+	}
+	p, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(p)
+	if err != nil || string(b) != "BODY\n" {
+		t.Errorf("body %q: %v", b, err)
+	}
+	if p.Filename != "X" {
+		t.Errorf("filename %q was not decoded", p.Filename)
+	}
+	if len(called) != 2 {
+		t.Errorf("CharsetReader was called for %v", called)
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
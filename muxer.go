@@ -1,7 +1,11 @@
 package lmail
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"runtime/debug"
 	"sync"
 )
 
@@ -10,7 +14,8 @@ import (
 // This muxer is fairly simple. you can register an address that receives its
 // own handler. Each handler is called if the address is registered otherwise
 // the default handler is called. The default Default handler is the
-// lmail.NullHandler
+// lmail.NullHandler. Each handler gets its own copy of the mail with its
+// recipient as the only one in Rcpts.
 type DefaultMuxer struct {
 	rcptHandlers   map[string]Handler
 	DefaultHandler Handler
@@ -24,43 +29,112 @@ func NewDefaultMuxer() *DefaultMuxer {
 	}
 }
 
-// HandleMail handles a mail and then calls the registerd Handler for the matching RCPTs.
+// HandleMail handles a mail and then calls the registerd Handler for the
+// matching RCPTs. It waits for all handlers and returns the code of the first
+// one that failed.
 func (m *DefaultMuxer) HandleMail(mail *Mail) (code int, err error) {
+	return m.HandleMailContext(mail.Context(), mail)
+}
+
+// HandleMailContext is HandleMail with a context that is passed on to the
+// registered Handlers. If ctx is done before the handlers returned, it waits
+// for them and fails the mail with a 451. If a handler panics, the panic is
+// raised again once all handlers returned, so the server logs it and aborts
+// the session as for any other Handler.
+func (m *DefaultMuxer) HandleMailContext(ctx context.Context, mail *Mail) (code int, err error) {
 	wg := &sync.WaitGroup{}
-	rChan := make(chan int, 2)
+	rChan := make(chan int, len(mail.Rcpts))
+	panics := make(chan *handlerPanic, 1)
 	for _, rcpt := range mail.Rcpts {
 		handler := m.rcptHandlers[rcpt]
 		if handler == nil {
 			handler = m.DefaultHandler
 		}
+		rcptMail := mail.Clone()
+		rcptMail.Rcpts = []string{rcpt}
 		wg.Add(1)
 		go func(handler Handler, mail *Mail, rChan chan int, wg *sync.WaitGroup) {
 			defer wg.Done()
-			code, err := handler.HandleMail(mail)
+			defer func() {
+				if r := recover(); r != nil {
+					select {
+					case panics <- &handlerPanic{r, debug.Stack()}:
+					default:
+					}
+					rChan <- CodeAborted
+				}
+			}()
+			code, err := handleMail(ctx, handler, mail)
 			if err != nil {
 				log.Println("Error in Handler:", err)
-				code = 500
+				var serr *SMTPError
+				if errors.As(err, &serr) {
+					code = serr.Code
+				} else {
+					code = 500
+				}
 			}
 			rChan <- code
 			return
-		}(handler, mail, rChan, wg)
+		}(handler, rcptMail, rChan, wg)
 	}
 
-	wgChan := make(chan bool)
+	wgChan := make(chan bool, 1)
 	go func() {
 		wg.Wait()
 		wgChan <- true
 		return
 	}()
+	// all handlers have to finish before the mail can be accepted, the
+	// first one that failed decides the reply. A cancelled context fails
+	// the mail temporarily, but the handlers still own the mail until
+	// they returned.
+	aborted := false
+	select {
+	case <-wgChan:
+	case <-ctx.Done():
+		<-wgChan
+		aborted = true
+	}
 	select {
-	case code := <-rChan:
-		if code != 250 {
+	case p := <-panics:
+		panic(p)
+	default:
+	}
+	if aborted {
+		return CodeAborted, &SMTPError{CodeAborted, "4.3.0", "Processing aborted: " + ctx.Err().Error()}
+	}
+	close(rChan)
+	for code := range rChan {
+		if code != 0 && code != CodeOk {
 			return code, nil
 		}
-	case <-wgChan:
-		break
 	}
-	return 250, nil
+	return CodeOk, nil
+}
+
+// handlerPanic carries the panic of a handler and the stack it happened on to
+// the goroutine that called the muxer.
+type handlerPanic struct {
+	value interface{}
+	stack []byte
+}
+
+func (p *handlerPanic) String() string {
+	return fmt.Sprintf("%v\n%s", p.value, p.stack)
+}
+
+// CheckRcpt implements RcptChecker by asking the Handler of rcpt, if it is a
+// RcptChecker.
+func (m *DefaultMuxer) CheckRcpt(ctx context.Context, from, rcpt string, size int64) error {
+	handler := m.rcptHandlers[rcpt]
+	if handler == nil {
+		handler = m.DefaultHandler
+	}
+	if checker, ok := handler.(RcptChecker); ok {
+		return checker.CheckRcpt(ctx, from, rcpt, size)
+	}
+	return nil
 }
 
 // AddRcptHandler registers a handler for an address string.
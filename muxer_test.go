@@ -0,0 +1,81 @@
+package lmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMuxerContextCancel(t *testing.T) {
+	var done int32
+	mux := NewDefaultMuxer()
+	mux.DefaultHandler = ContextHandlerFunc(func(ctx context.Context, m *Mail) (int, error) {
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		atomic.StoreInt32(&done, 1)
+		return CodeOk, nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	m := newTestMail(strings.NewReader("Subject: cancel\n\nbody\n"), "a@example.net", "b@example.net")
+	defer m.Close()
+	code, err := mux.HandleMailContext(ctx, m)
+	if atomic.LoadInt32(&done) != 1 {
+		t.Error("muxer returned before its handlers")
+	}
+	var serr *SMTPError
+	if code != CodeAborted || !errors.As(err, &serr) || serr.Code != CodeAborted {
+		t.Errorf("got %d %v, want a %d SMTPError", code, err, CodeAborted)
+	}
+}
+
+func TestMuxerSessionContext(t *testing.T) {
+	type values struct {
+		id, addr string
+		tls      bool
+	}
+	got := make(chan values, 2)
+	mux := NewDefaultMuxer()
+	mux.DefaultHandler = ContextHandlerFunc(func(ctx context.Context, m *Mail) (int, error) {
+		v := values{id: SessionID(ctx), tls: TLSState(ctx) != nil}
+		if addr := RemoteAddr(ctx); addr != nil {
+			v.addr = addr.String()
+		}
+		got <- v
+		return CodeOk, nil
+	})
+	srv := &Server{Name: "test", Handler: mux}
+	text := pipeSession(t, srv)
+	defer text.Close()
+	expect(t, text, "", CodeReady)
+	expect(t, text, "HELO localhost", CodeOk)
+	expect(t, text, "MAIL FROM:<sender@example.org>", CodeOk)
+	expect(t, text, "RCPT TO:<a@example.net>", CodeOk)
+	expect(t, text, "RCPT TO:<b@example.net>", CodeOk)
+	expect(t, text, "DATA", CodeStartMailInput)
+	w := text.DotWriter()
+	fmt.Fprint(w, "Subject: values\n\nbody\n")
+	w.Close()
+	expect(t, text, "", CodeOk)
+	close(got)
+	var id string
+	for v := range got {
+		if v.id == "" || (id != "" && v.id != id) {
+			t.Errorf("session id %q, want a single non-empty id", v.id)
+		}
+		id = v.id
+		if v.addr != "pipe" {
+			t.Errorf("remote address %q, want pipe", v.addr)
+		}
+		if v.tls {
+			t.Error("TLS state on an unencrypted session")
+		}
+	}
+	if id == "" {
+		t.Error("handler was not called")
+	}
+}
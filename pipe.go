@@ -0,0 +1,194 @@
+package lmail
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Defaults of the Pipe handler, used if the corresponding field is zero.
+const (
+	DefaultPipeTimeout   = 5 * time.Minute
+	DefaultPipeMaxOutput = 4 << 10
+)
+
+// maximum length of command output in a reply
+const maxPipeReply = 200
+
+// sysexits maps the exit codes of sysexits.h to SMTP replies. Codes that are
+// not listed are taken as temporary failures.
+var sysexits = map[int]SMTPError{
+	64: {CodeTransactionFailed, "5.3.0", "Command line usage error"},  // EX_USAGE
+	65: {CodeTransactionFailed, "5.6.0", "Data format error"},         // EX_DATAERR
+	66: {CodeTransactionFailed, "5.3.0", "Cannot open input"},         // EX_NOINPUT
+	67: {CodeNotTaken, "5.1.1", "User unknown"},                       // EX_NOUSER
+	68: {CodeNotTaken, "5.1.2", "Host name unknown"},                  // EX_NOHOST
+	69: {CodeTransactionFailed, "5.3.0", "Service unavailable"},       // EX_UNAVAILABLE
+	70: {CodeTransactionFailed, "5.3.0", "Internal software error"},   // EX_SOFTWARE
+	71: {CodeAborted, "4.3.0", "System error"},                        // EX_OSERR
+	72: {CodeTransactionFailed, "5.3.0", "Critical OS file missing"},  // EX_OSFILE
+	73: {CodeTransactionFailed, "5.2.0", "Cannot create output file"}, // EX_CANTCREAT
+	74: {CodeTransactionFailed, "5.3.0", "Input/output error"},        // EX_IOERR
+	75: {CodeAborted, "4.3.0", "Temporary failure"},                   // EX_TEMPFAIL
+	76: {CodeTransactionFailed, "5.5.0", "Remote error in protocol"},  // EX_PROTOCOL
+	77: {CodeNotTaken, "5.7.0", "Permission denied"},                  // EX_NOPERM
+	78: {CodeAborted, "4.3.5", "Configuration error"},                 // EX_CONFIG
+}
+
+// Pipe is a mail Handler that runs a command for every recipient of a mail
+// and writes the message to its standard input. The envelope is passed in
+// the environment:
+//
+//	SENDER          envelope sender
+//	RECIPIENT       envelope recipient
+//	LOCAL, DOMAIN   local part and domain of the recipient
+//	CLIENT_ADDRESS  IP address of the client
+//	CLIENT_HELO     name the client gave in HELO or EHLO
+//	CLIENT_HOSTNAME name of the client found by reverse lookup
+//	QUEUE_ID        ID of the mail transaction
+//	SESSION_ID      ID of the session
+//
+// The exit code of the command decides the reply as in sysexits.h, e.g. 75
+// (EX_TEMPFAIL) gives 451 and 67 (EX_NOUSER) 550. Unknown exit codes, a
+// timeout and commands that could not be run are temporary failures. The
+// reply carries the first line of the command's standard error output.
+type Pipe struct {
+	Command string
+	Args    []string
+	// Additional environment variables in the form "key=value". Only PATH
+	// is taken from the environment of the server.
+	Env []string
+	// Working directory of the command, the one of the server if empty.
+	Dir string
+	// Time the command may run, if zero DefaultPipeTimeout is used.
+	Timeout time.Duration
+	// Bytes of the error output of the command that are kept for the log
+	// and the reply, the rest is discarded like the standard output. If
+	// zero DefaultPipeMaxOutput is used.
+	MaxOutput int
+}
+
+// NewPipe returns a Pipe handler that runs command with args.
+func NewPipe(command string, args ...string) *Pipe {
+	return &Pipe{Command: command, Args: args}
+}
+
+// HandleMail runs the command for every recipient of the mail.
+func (p *Pipe) HandleMail(m *Mail) (int, error) {
+	return p.HandleMailContext(m.Context(), m)
+}
+
+// HandleMailContext is HandleMail with a context, the command is killed if
+// ctx is done before it exits.
+func (p *Pipe) HandleMailContext(ctx context.Context, m *Mail) (int, error) {
+	for _, rcpt := range m.Rcpts {
+		if err := p.run(ctx, m, rcpt); err != nil {
+			return err.Code, err
+		}
+	}
+	return CodeOk, nil
+}
+
+// environ returns the environment of the command for rcpt.
+func (p *Pipe) environ(m *Mail, rcpt string) []string {
+	local, domain := rcpt, ""
+	if i := strings.LastIndex(rcpt, "@"); i >= 0 {
+		local, domain = rcpt[:i], rcpt[i+1:]
+	}
+	env := []string{
+		"PATH=" + os.Getenv("PATH"),
+		"SENDER=" + m.From,
+		"RECIPIENT=" + rcpt,
+		"LOCAL=" + local,
+		"DOMAIN=" + domain,
+		"CLIENT_HELO=" + m.ClientName,
+		"CLIENT_HOSTNAME=" + m.Client,
+		"QUEUE_ID=" + m.QueueID,
+		"SESSION_ID=" + m.SessionID,
+	}
+	if m.RemoteAddr != nil {
+		env = append(env, "CLIENT_ADDRESS="+addrIP(m.RemoteAddr))
+	}
+	return append(env, p.Env...)
+}
+
+// run runs the command for rcpt and returns the reply if it failed.
+func (p *Pipe) run(ctx context.Context, m *Mail, rcpt string) *SMTPError {
+	ctx, cancel := context.WithTimeout(ctx, orDefault(p.Timeout, DefaultPipeTimeout))
+	defer cancel()
+	max := p.MaxOutput
+	if max <= 0 {
+		max = DefaultPipeMaxOutput
+	}
+	stderr := &limitedBuffer{max: max}
+	cmd := exec.CommandContext(ctx, p.Command, p.Args...)
+	cmd.Env = p.environ(m, rcpt)
+	cmd.Dir = p.Dir
+	cmd.Stdin = m.RawReader()
+	// a killed command must not wait for the rest of the message
+	cmd.WaitDelay = time.Second
+	cmd.Stdout = ioutil.Discard
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	log.Printf("Pipe: %s for %s of %s failed: %s: %s", p.Command, rcpt, m.QueueID, err, stderr.buf)
+	if ctx.Err() == context.DeadlineExceeded {
+		return &SMTPError{CodeAborted, "4.4.7", "Command timed out"}
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() < 0 {
+		// not started or killed by a signal
+		return &SMTPError{CodeAborted, "4.3.0", "Command failed"}
+	}
+	reply, ok := sysexits[exitErr.ExitCode()]
+	if !ok {
+		reply = SMTPError{CodeAborted, "4.3.0", "Command failed"}
+	}
+	if msg := pipeReply(stderr.buf); msg != "" {
+		reply.Message = msg
+	}
+	return &reply
+}
+
+// pipeReply returns the first line of the output of a command, shortened to
+// fit into a reply.
+func pipeReply(output []byte) string {
+	line := strings.TrimSpace(string(output))
+	if i := strings.IndexAny(line, "\r\n"); i >= 0 {
+		line = strings.TrimSpace(line[:i])
+	}
+	line = strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return '?'
+		}
+		return r
+	}, line)
+	if len(line) > maxPipeReply {
+		line = line[:maxPipeReply]
+	}
+	return line
+}
+
+// limitedBuffer keeps the first max bytes written to it and discards the
+// rest, so that a command never blocks on its output.
+type limitedBuffer struct {
+	buf []byte
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if rest := b.max - len(b.buf); rest > 0 {
+		if len(p) < rest {
+			rest = len(p)
+		}
+		b.buf = append(b.buf, p[:rest]...)
+	}
+	return len(p), nil
+}
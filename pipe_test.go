@@ -0,0 +1,50 @@
+package lmail
+
+import (
+	"errors"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPipe(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no shell to run commands")
+	}
+	dir := testDir(t)
+
+	p := NewPipe(sh, "-c", `cat > "$RECIPIENT"; echo "$SENDER" >> "$RECIPIENT"`)
+	p.Dir = dir
+	if code := deliverTestMail(t, p, "rcpt@example.net", "Subject: piped\n\nbody\n"); code != CodeOk {
+		t.Fatalf("pipe failed with %d", code)
+	}
+	b, err := ioutil.ReadFile(dir + "/rcpt@example.net")
+	if err != nil || string(b) != "Subject: piped\n\nbody\nsender@example.org\n" {
+		t.Errorf("command got %q: %v", b, err)
+	}
+
+	tests := []struct {
+		script string
+		code   int
+		reply  string
+	}{
+		{"echo 'no such user' >&2; exit 67", CodeNotTaken, "5.1.1 no such user"},
+		{"exit 75", CodeAborted, "4.3.0 Temporary failure"},
+		{"exit 3", CodeAborted, "4.3.0 Command failed"},
+		{"sleep 5", CodeAborted, "4.4.7 Command timed out"},
+	}
+	for _, test := range tests {
+		p := NewPipe(sh, "-c", test.script)
+		p.Timeout = 100 * time.Millisecond
+		m := newTestMail(strings.NewReader("Subject: x\n\nbody\n"), "rcpt@example.net")
+		code, err := p.HandleMail(m)
+		m.Close()
+		var serr *SMTPError
+		if code != test.code || !errors.As(err, &serr) || serr.reply() != test.reply {
+			t.Errorf("%s: got %d %v, expected %d %s", test.script, code, err, test.code, test.reply)
+		}
+	}
+}
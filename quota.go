@@ -0,0 +1,224 @@
+package lmail
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Quota limits the storage of a mailbox. A zero field means no limit.
+type Quota struct {
+	Bytes    int64
+	Messages int64
+}
+
+// QuotaPolicy decides how a mail is rejected that exceeds a quota.
+type QuotaPolicy int
+
+const (
+	// QuotaTemporary rejects with 452 4.2.2, the sender retries later
+	// when the mailbox might have been emptied. This is the default.
+	QuotaTemporary QuotaPolicy = iota
+	// QuotaPermanent rejects with 552 5.2.2, the mail is bounced.
+	QuotaPermanent
+)
+
+func (p QuotaPolicy) error() *SMTPError {
+	if p == QuotaPermanent {
+		return &SMTPError{CodeMailAborted, "5.2.2", "Mailbox full"}
+	}
+	return &SMTPError{CodeInsufficientStorage, "4.2.2", "Mailbox full"}
+}
+
+// RcptChecker is implemented by Handlers that can tell whether they will
+// accept a mail for a recipient before the mail is sent. size is the size the
+// client declared with the SIZE parameter or 0. If the error is an
+// *SMTPError the client receives it as reply to RCPT.
+type RcptChecker interface {
+	CheckRcpt(ctx context.Context, from, rcpt string, size int64) error
+}
+
+const (
+	maildirSizeFile = "maildirsize"
+	// maildirsize is recalculated when it grows beyond this size or is
+	// older than maildirSizeAge and over quota, see the Maildir++
+	// specification.
+	maildirSizeLimit = 5120
+	maildirSizeAge   = 15 * time.Minute
+)
+
+// quotaRoot returns the Maildir that holds the maildirsize file of m.
+func (m *Maildir) quotaRoot() *Maildir {
+	if m.parent != nil {
+		return m.parent
+	}
+	return m
+}
+
+func (q Quota) String() string {
+	var parts []string
+	if q.Bytes > 0 {
+		parts = append(parts, fmt.Sprintf("%dS", q.Bytes))
+	}
+	if q.Messages > 0 {
+		parts = append(parts, fmt.Sprintf("%dC", q.Messages))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (q Quota) exceeded(usage Quota) bool {
+	return (q.Bytes > 0 && usage.Bytes > q.Bytes) || (q.Messages > 0 && usage.Messages > q.Messages)
+}
+
+// readMaildirSize sums up the maildirsize file. It returns false if the file
+// has to be recalculated.
+func (m *Maildir) readMaildirSize() (usage Quota, ok bool) {
+	f, err := os.Open(m.directory + "/" + maildirSizeFile)
+	if err != nil {
+		return usage, false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.Size() > maildirSizeLimit {
+		return usage, false
+	}
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() || scanner.Text() != m.Quota.String() {
+		// the quota changed since the file was written
+		return usage, false
+	}
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			return usage, false
+		}
+		bytes, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return usage, false
+		}
+		count, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return usage, false
+		}
+		usage.Bytes += bytes
+		usage.Messages += count
+	}
+	if scanner.Err() != nil {
+		return usage, false
+	}
+	if m.Quota.exceeded(usage) && time.Since(fi.ModTime()) > maildirSizeAge {
+		// make sure the mailbox is really full
+		return usage, false
+	}
+	return usage, true
+}
+
+// recalculateQuota counts the mails in the Maildir and all its folders and
+// replaces maildirsize with the result. The new file is written to tmp first,
+// so readers never see a partial file.
+func (m *Maildir) recalculateQuota() (Quota, error) {
+	var usage Quota
+	dirs := []string{m.directory}
+	entries, err := ioutil.ReadDir(m.directory)
+	if os.IsNotExist(err) {
+		// the mailbox gets created with its first mail
+		return usage, nil
+	}
+	if err != nil {
+		return usage, err
+	}
+	for _, fi := range entries {
+		if fi.IsDir() && strings.HasPrefix(fi.Name(), ".") && fi.Name() != "." && fi.Name() != ".." {
+			dirs = append(dirs, m.directory+"/"+fi.Name())
+		}
+	}
+	for _, dir := range dirs {
+		for _, sub := range []string{"/new", "/cur"} {
+			files, err := ioutil.ReadDir(dir + sub)
+			if err != nil && !os.IsNotExist(err) {
+				return usage, err
+			}
+			for _, fi := range files {
+				if fi.IsDir() {
+					continue
+				}
+				usage.Bytes += fi.Size()
+				usage.Messages++
+			}
+		}
+	}
+	unique, err := createUniqueName()
+	if err != nil {
+		return usage, err
+	}
+	tmp := m.directory + "/tmp/" + unique
+	content := fmt.Sprintf("%s\n%d %d\n", m.Quota, usage.Bytes, usage.Messages)
+	if err := ioutil.WriteFile(tmp, []byte(content), MaildirCreateMode); err != nil {
+		return usage, err
+	}
+	if err := os.Rename(tmp, m.directory+"/"+maildirSizeFile); err != nil {
+		os.Remove(tmp)
+		return usage, err
+	}
+	return usage, nil
+}
+
+// checkQuota returns the error of the QuotaPolicy if a mail of size bytes
+// does not fit into the mailbox.
+func (m *Maildir) checkQuota(size int64) error {
+	root := m.quotaRoot()
+	if root.Quota == (Quota{}) {
+		return nil
+	}
+	usage, ok := root.readMaildirSize()
+	if !ok {
+		var err error
+		usage, err = root.recalculateQuota()
+		if err != nil {
+			return fmt.Errorf("could not calculate quota: %s", err)
+		}
+	}
+	usage.Bytes += size
+	usage.Messages++
+	if root.Quota.exceeded(usage) {
+		return root.QuotaPolicy.error()
+	}
+	return nil
+}
+
+// addQuota records a delivered mail in maildirsize.
+func (m *Maildir) addQuota(size int64) error {
+	root := m.quotaRoot()
+	if root.Quota == (Quota{}) {
+		return nil
+	}
+	err := root.appendMaildirSize(size, 1)
+	if os.IsNotExist(err) {
+		_, err = root.recalculateQuota()
+	}
+	return err
+}
+
+// appendMaildirSize adds a line to an existing maildirsize file.
+func (m *Maildir) appendMaildirSize(bytes, count int64) error {
+	f, err := os.OpenFile(m.directory+"/"+maildirSizeFile, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d %d\n", bytes, count)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// CheckRcpt implements RcptChecker, it checks whether a mail of the given
+// size fits into the quota of the Maildir.
+func (m *Maildir) CheckRcpt(ctx context.Context, from, rcpt string, size int64) error {
+	return m.checkQuota(size)
+}
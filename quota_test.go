@@ -0,0 +1,33 @@
+package lmail
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMaildirQuota(t *testing.T) {
+	dir := testDir(t)
+	store := NewMaildirStore(dir, "{domain}/{local}/")
+	store.Quota = Quota{Messages: 2}
+	store.QuotaPolicy = QuotaPermanent
+	for i, want := range []int{CodeOk, CodeOk, CodeMailAborted} {
+		if code := deliverTestMail(t, store, "rcpt@example.net", "Subject: quota\n\nbody\n"); code != want {
+			t.Errorf("delivery %d: expected %d, got %d", i, want, code)
+		}
+	}
+	if err := store.CheckRcpt(context.Background(), "", "rcpt@example.net", 0); err == nil {
+		t.Error("full mailbox accepted mail at RCPT time")
+	}
+	// a deleted message makes room again
+	md := store.newMaildir(dir + "/example.net/rcpt")
+	messages, err := md.Messages()
+	if err != nil || len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d: %v", len(messages), err)
+	}
+	if err := messages[0].Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CheckRcpt(context.Background(), "", "rcpt@example.net", 0); err != nil {
+		t.Errorf("mail rejected after delete: %s", err)
+	}
+}
@@ -0,0 +1,165 @@
+package lmail
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimitStore keeps the state of token buckets. The default store keeps
+// its buckets in memory, other implementations may keep them in a store that
+// is shared between several servers.
+type RateLimitStore interface {
+	// Take removes n tokens from each of the buckets identified by keys.
+	// A bucket holds at most capacity tokens and is refilled with
+	// capacity tokens per period. It returns false if any of the buckets
+	// does not hold enough tokens, in which case no tokens are removed
+	// from any of them.
+	Take(keys []string, n, capacity int, period time.Duration) (bool, error)
+}
+
+type bucket struct {
+	tokens   float64
+	last     time.Time
+	rate     float64 // tokens per nanosecond
+	capacity float64
+}
+
+// refill adds the tokens that accrued since the last use.
+func (b *bucket) refill(now time.Time) {
+	b.tokens += b.rate * float64(now.Sub(b.last))
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+}
+
+// MemoryRateLimitStore is a RateLimitStore that keeps its buckets in memory.
+// The zero value is ready to use.
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	takes   int
+}
+
+// NewMemoryRateLimitStore returns a new empty in memory store.
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{}
+}
+
+// Take implements RateLimitStore.
+func (s *MemoryRateLimitStore) Take(keys []string, n, capacity int, period time.Duration) (bool, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buckets == nil {
+		s.buckets = make(map[string]*bucket)
+	}
+	// every now and then drop buckets that are full again, they carry no
+	// information anymore. Each bucket is judged by its own limit.
+	s.takes++
+	if s.takes%1024 == 0 {
+		for k, b := range s.buckets {
+			if b.tokens+b.rate*float64(now.Sub(b.last)) >= b.capacity {
+				delete(s.buckets, k)
+			}
+		}
+	}
+	buckets := make([]*bucket, len(keys))
+	for i, key := range keys {
+		b, ok := s.buckets[key]
+		if !ok {
+			b = &bucket{tokens: float64(capacity), last: now}
+			s.buckets[key] = b
+		}
+		b.rate = float64(capacity) / float64(period)
+		b.capacity = float64(capacity)
+		b.refill(now)
+		if b.tokens < float64(n) {
+			return false, nil
+		}
+		buckets[i] = b
+	}
+	for _, b := range buckets {
+		b.tokens -= float64(n)
+	}
+	return true, nil
+}
+
+// RateLimiter limits how many connections, messages and recipients a client
+// may use. Connections are counted per client IP, messages per client IP, per
+// envelope sender and per authenticated identity. A limit of 0 disables it.
+//
+// If the store returns an error the limit is not enforced and the error is
+// logged.
+type RateLimiter struct {
+	// Store keeps the bucket state, if nil an in memory store is used.
+	Store RateLimitStore
+
+	// Connections a single IP may open per minute.
+	ConnectionsPerMinute int
+	// Messages per hour a single IP, sender or authenticated user may send.
+	MessagesPerHour int
+	// Recipients a single message may have.
+	RecipientsPerMessage int
+
+	once sync.Once
+}
+
+func (rl *RateLimiter) store() RateLimitStore {
+	rl.once.Do(func() {
+		if rl.Store == nil {
+			rl.Store = NewMemoryRateLimitStore()
+		}
+	})
+	return rl.Store
+}
+
+// take takes a token from each bucket of keys or none if one is empty.
+func (rl *RateLimiter) take(srv *Server, keys []string, capacity int, period time.Duration) bool {
+	ok, err := rl.store().Take(keys, 1, capacity, period)
+	if err != nil {
+		srv.logf("Rate limit store failed for %v: %s", keys, err)
+		return true
+	}
+	return ok
+}
+
+// allowConnection checks if a new connection from addr may be served.
+func (rl *RateLimiter) allowConnection(srv *Server, addr net.Addr) bool {
+	if rl.ConnectionsPerMinute <= 0 {
+		return true
+	}
+	return rl.take(srv, []string{"conn:ip:" + addrIP(addr)}, rl.ConnectionsPerMinute, time.Minute)
+}
+
+// allowMessage checks if a new message may be started. auth is empty for
+// unauthenticated sessions. Tokens are only taken if none of the IP, the
+// sender and the identity is over the limit.
+func (rl *RateLimiter) allowMessage(srv *Server, addr net.Addr, from, auth string) bool {
+	if rl.MessagesPerHour <= 0 {
+		return true
+	}
+	keys := []string{"msg:ip:" + addrIP(addr), "msg:from:" + from}
+	if auth != "" {
+		keys = append(keys, "msg:auth:"+auth)
+	}
+	return rl.take(srv, keys, rl.MessagesPerHour, time.Hour)
+}
+
+// allowRecipient checks if a message that already has n recipients may get
+// another one.
+func (rl *RateLimiter) allowRecipient(n int) bool {
+	if rl.RecipientsPerMessage <= 0 {
+		return true
+	}
+	return n < rl.RecipientsPerMessage
+}
+
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,87 @@
+package lmail
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	s := NewMemoryRateLimitStore()
+	for i := 0; i < 3; i++ {
+		ok, err := s.Take([]string{"ip:127.0.0.1"}, 1, 3, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("take %d was refused", i)
+		}
+	}
+	ok, _ := s.Take([]string{"ip:127.0.0.1"}, 1, 3, time.Hour)
+	if ok {
+		t.Fatal("bucket should be empty")
+	}
+	ok, _ = s.Take([]string{"ip:127.0.0.2"}, 1, 3, time.Hour)
+	if !ok {
+		t.Fatal("buckets are not separated by key")
+	}
+	ok, _ = s.Take([]string{"refill"}, 1, 1, time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	ok2, _ := s.Take([]string{"refill"}, 1, 1, time.Millisecond)
+	if !ok || !ok2 {
+		t.Fatal("bucket was not refilled")
+	}
+}
+
+func TestMemoryRateLimitStoreAllOrNothing(t *testing.T) {
+	s := NewMemoryRateLimitStore()
+	if ok, _ := s.Take([]string{"a"}, 1, 1, time.Hour); !ok {
+		t.Fatal("take was refused")
+	}
+	// b must keep its token as a is empty
+	if ok, _ := s.Take([]string{"b", "a"}, 1, 1, time.Hour); ok {
+		t.Fatal("empty bucket was not noticed")
+	}
+	if ok, _ := s.Take([]string{"b"}, 1, 1, time.Hour); !ok {
+		t.Fatal("token was taken from a bucket of a refused take")
+	}
+}
+
+func TestMemoryRateLimitStoreSweep(t *testing.T) {
+	s := NewMemoryRateLimitStore()
+	if ok, _ := s.Take([]string{"hourly"}, 1, 1, time.Hour); !ok {
+		t.Fatal("take was refused")
+	}
+	// the sweep runs with the limit of another bucket
+	time.Sleep(2 * time.Millisecond)
+	for i := 0; i < 1024; i++ {
+		s.Take([]string{"fast"}, 1, 1000, time.Millisecond)
+	}
+	if ok, _ := s.Take([]string{"hourly"}, 1, 1, time.Hour); ok {
+		t.Fatal("sweep reset an exhausted bucket")
+	}
+}
+
+func TestRateLimiterAuthKey(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	rl := &RateLimiter{Store: store, MessagesPerHour: 1}
+	srv := &Server{}
+	a := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}
+	b := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 25}
+	if !rl.allowMessage(srv, a, "one@example.org", "user") {
+		t.Fatal("first message was refused")
+	}
+	// another IP and sender, but the same account
+	if rl.allowMessage(srv, b, "two@example.org", "user") {
+		t.Error("identity was not limited")
+	}
+	if _, ok := store.buckets["msg:auth:user"]; !ok {
+		t.Error("no bucket for the identity")
+	}
+	if !rl.allowMessage(srv, b, "two@example.org", "") {
+		t.Error("unauthenticated message was limited by the identity")
+	}
+	if _, ok := store.buckets["msg:auth:"]; ok {
+		t.Error("bucket for an empty identity")
+	}
+}
@@ -0,0 +1,118 @@
+package lmail
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// RecipientAction is what a RecipientCheck does with a suspicious message.
+// Actions can be combined.
+type RecipientAction int
+
+const (
+	// RecipientTag adds an X-Recipient-Mismatch field to the message. The
+	// field only carries the number of mismatches, envelope-only
+	// recipients are blind copies and must not be revealed.
+	RecipientTag RecipientAction = 1 << iota
+	// RecipientLog writes the mismatch to the server's log.
+	RecipientLog
+	// RecipientReject rejects the message with 550 5.7.1.
+	RecipientReject
+)
+
+// RecipientCheck compares the envelope recipients of a message with the
+// addresses in its To, Cc and Bcc fields, or their Resent- counterparts. The
+// result is stored in Mail.EnvelopeOnly and Mail.HeaderOnly.
+//
+// Envelope-only recipients are usually blind copies, header-only recipients
+// are delivered by other servers. Which of them make a message suspicious
+// depends on where the server sits, a submission server might reject
+// messages of its users that go to recipients not named in the header.
+type RecipientCheck struct {
+	// Action is taken if the message is suspicious.
+	Action RecipientAction
+	// Messages with envelope-only recipients are suspicious.
+	EnvelopeOnly bool
+	// Messages with header-only recipients are suspicious.
+	HeaderOnly bool
+	// Only check messages of clients that authenticated. As the server
+	// does not support AUTH yet, no message is checked if this is set.
+	Authenticated bool
+}
+
+// recipientFields are the header fields that name the recipients of a
+// message.
+var recipientFields = []string{"To", "Cc", "Bcc"}
+
+// matchRecipients returns the envelope recipients that are not named in the
+// header and the header recipients that are not in the envelope. Addresses
+// are compared case insensitively. If the message was resent, the Resent-
+// fields are compared instead of the original ones (rfc5322 3.6.6).
+func matchRecipients(rcpts []string, header mail.Header) (envelopeOnly, headerOnly []string) {
+	fields := recipientFields
+	if header.Get("Resent-To") != "" || header.Get("Resent-Cc") != "" || header.Get("Resent-Bcc") != "" {
+		fields = []string{"Resent-To", "Resent-Cc", "Resent-Bcc"}
+	}
+	// true once an address was found in the envelope and the header
+	envelope := make(map[string]bool)
+	for _, rcpt := range rcpts {
+		envelope[strings.ToLower(rcpt)] = false
+	}
+	seen := make(map[string]bool)
+	for _, key := range fields {
+		addresses, err := header.AddressList(key)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addresses {
+			lower := strings.ToLower(addr.Address)
+			if _, ok := envelope[lower]; ok {
+				envelope[lower] = true
+			} else if !seen[lower] {
+				headerOnly = append(headerOnly, addr.Address)
+			}
+			seen[lower] = true
+		}
+	}
+	for _, rcpt := range rcpts {
+		lower := strings.ToLower(rcpt)
+		if !envelope[lower] {
+			envelopeOnly = append(envelopeOnly, rcpt)
+			// report duplicate envelope recipients once
+			envelope[lower] = true
+		}
+	}
+	return
+}
+
+// checkRecipients runs the server's RecipientCheck on the current mail. It
+// returns an error if the message is rejected.
+func (s *session) checkRecipients() error {
+	check := s.server.RecipientCheck
+	if check == nil || (check.Authenticated && s.mail.AuthIdentity == "") {
+		return nil
+	}
+	msg, err := s.mail.MimeMessage()
+	if err != nil {
+		// a broken header is the business of the validation
+		return nil
+	}
+	m := s.mail
+	m.EnvelopeOnly, m.HeaderOnly = matchRecipients(m.Rcpts, msg.Header)
+	if !(check.EnvelopeOnly && len(m.EnvelopeOnly) > 0) && !(check.HeaderOnly && len(m.HeaderOnly) > 0) {
+		return nil
+	}
+	if check.Action&RecipientLog != 0 {
+		s.server.logf("Recipient mismatch in %s from %s: envelope only %v, header only %v",
+			m.QueueID, m.From, m.EnvelopeOnly, m.HeaderOnly)
+	}
+	if check.Action&RecipientReject != 0 {
+		return &SMTPError{CodeNotTaken, "5.7.1", "Envelope recipients do not match the message header"}
+	}
+	if check.Action&RecipientTag != 0 {
+		m.AddHeader("X-Recipient-Mismatch", fmt.Sprintf("envelope-only=%d header-only=%d",
+			len(m.EnvelopeOnly), len(m.HeaderOnly)))
+	}
+	return nil
+}
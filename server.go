@@ -1,27 +1,28 @@
 package lmail
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/mail"
 	"net/textproto"
 	"os"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // preliminary location to store extension list supported by the server
 var extensions = []string{"8BITMIME", "SIZE", "STARTTLS"}
 
-// The server timour is set to 5 minuted as proposed in rfc5321 4.5.3.2.7.
-const timeoutTime time.Duration = 5 * time.Minute
-
-// Processing time out is set to 8 hours because it seems reasonable
-const processingTimeout time.Duration = 8 * time.Hour
-
 // Maildir instance, shall contain folder name
 var maildir *Maildir
 
@@ -31,54 +32,113 @@ type Handler interface {
 	// an smtp error, and an error object for all other errors.
 	// If the smtp error code is 0 or err is not nil it is ignored.
 	// if err is not nil, the server will respond with the appropriate
-	// error code or ignore the handler
+	// error code or ignore the handler. If err is an *SMTPError the client
+	// receives its reply.
 	HandleMail(*Mail) (int, error)
 }
 
 type session struct {
-	conn      net.Conn        // raw network connection
+	id        string          // unique session ID
+	ctx       context.Context // cancelled when the session ends
+	cancel    context.CancelFunc
+	conn      *timeoutConn    // network connection with deadlines
 	text      *textproto.Conn // Textproto context
 	active    bool            // check if session is still active
 	pastHello bool            // check if EHLO/HELO ran yet
 	starttls  bool            // true if tls session
-	timeout   *time.Timer     // server timeout
-	timedout  bool            // connection time out
+	wait      time.Duration   // how long to wait for the next command
 	mail      *Mail           // The mail the is beeing received.
+	auth      string          // identity established by AUTH, always empty until AUTH is implemented
 	server    *Server         // The server whom initiated the session
 
+	connected time.Time            // time the client connected
+	tls       *tls.ConnectionState // nil if the session is not encrypted
+	client    string               // reverse lookup of the client address
+	helo      string               // name given in HELO or EHLO
+	esmtp     bool                 // true if the client used EHLO
+	idle      int32                // 1 while waiting for a command outside of a transaction, atomic
+
 	// Delivery Function
-	handle func(*Mail) (int, error)
+	handle func(context.Context, *Mail) (int, error)
 	// Verify Function
 	Verify func(io.ReadWriter) (bool, error)
 }
 
 func newSession(conn net.Conn, server *Server) *session {
 	s := &session{
-		conn:   conn,
-		text:   textproto.NewConn(conn),
-		mail:   &Mail{},
-		server: server,
-	}
+		id:        newID(),
+		server:    server,
+		wait:      server.greetingTimeout(),
+		connected: time.Now(),
+	}
+	ctx := context.WithValue(context.Background(), sessionIDKey, s.id)
+	ctx = context.WithValue(ctx, remoteAddrKey, conn.RemoteAddr())
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		s.tls = &state
+		ctx = context.WithValue(ctx, tlsStateKey, &state)
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	s.conn = &timeoutConn{Conn: conn, write: server.commandTimeout(), cancel: s.cancel}
+	s.text = textproto.NewConn(s.conn)
 	s.reset()
-	s.timeout = time.AfterFunc(timeoutTime, func() {
-		s.Close()
-	})
 	return s
 }
 
 func (s *session) reset() {
 	s.active = true
 	s.pastHello = false
-	s.timedout = false
+	s.resetMail()
+}
+
+// resetMail starts a new mail transaction.
+func (s *session) resetMail() {
+	s.mail = &Mail{
+		Client:       s.client,
+		ClientName:   s.helo,
+		QueueID:      newID(),
+		SessionID:    s.id,
+		ConnectedAt:  s.connected,
+		RemoteAddr:   s.conn.RemoteAddr(),
+		LocalAddr:    s.conn.LocalAddr(),
+		TLS:          s.tls,
+		AuthIdentity: s.auth,
+		ESMTP:        s.esmtp,
+	}
+}
+
+// handleTimeout tells the client that it took too long and closes the
+// session.
+func (s *session) handleTimeout() {
+	s.active = false
+	s.Cmd(CodeNotAvailable, "4.4.2 %s Timeout exceeded, closing connection", s.server.Name)
+	s.Close()
+}
+
+// handleShutdown tells the client that the server shuts down and closes the
+// session.
+func (s *session) handleShutdown() {
+	s.active = false
+	s.Cmd(CodeNotAvailable, "4.3.2 %s Service shutting down", s.server.Name)
+	s.Close()
 }
 
-func (s *session) ResetTimeout() {
-	s.timeout.Reset(timeoutTime)
+// recoverPanic recovers from a panic in the session or its Handler. The
+// panic is logged with its stack trace and only this session's connection is
+// closed.
+func (s *session) recoverPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	s.server.logf("Panic in session %s with %s: %v\n%s", s.id, s.conn.RemoteAddr(), r, debug.Stack())
+	s.active = false
+	s.Cmd(CodeAborted, "4.3.0 Internal error")
+	s.Close()
 }
 
 func (s *session) Close() error {
-	s.timedout = true
-	s.timeout.Stop()
+	s.cancel()
 	err := s.text.Close()
 	if err != nil {
 		return fmt.Errorf("failed to close Session: %s", err)
@@ -94,6 +154,25 @@ func getTouple(field string) (string, string, error) {
 	return kv[0], kv[1], nil
 }
 
+// parseParams parses ESMTP parameters as in rfc5321 4.1.2. Keywords are
+// upper cased, parameters without value map to an empty string.
+func parseParams(args []string) (map[string]string, error) {
+	params := make(map[string]string)
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if kv[0] == "" {
+			return nil, fmt.Errorf("empty parameter keyword")
+		}
+		key := strings.ToUpper(kv[0])
+		if len(kv) == 2 {
+			params[key] = kv[1]
+		} else {
+			params[key] = ""
+		}
+	}
+	return params, nil
+}
+
 func getAddress(value string) string {
 	value = strings.TrimLeft(value, "<")
 	return strings.TrimRight(value, ">")
@@ -113,7 +192,10 @@ func (s *session) handleHelo(args []string) {
 	client := args[1]
 	// TODO: validate URL
 	s.Cmd(CodeOk, "Hello %s, use EHLO, motherfucker.", client)
+	s.helo = client
+	s.esmtp = false
 	s.pastHello = true
+	s.resetMail()
 }
 
 func (s *session) replyExtensions(client string) error {
@@ -132,9 +214,9 @@ func (s *session) replyExtensions(client string) error {
 	} else {
 		name = names[0]
 	}
-	s.mail.Client = name
+	s.client = name
 	s.Ecmd(CodeOk, "%s, Hello %s [%s]", s.server.Name, name, rAddr)
-	for _, extension := range extensions[:1] {
+	for _, extension := range extensions[:len(extensions)-1] {
 		s.Ecmd(CodeOk, extension)
 	}
 	s.Cmd(CodeOk, extensions[len(extensions)-1])
@@ -152,7 +234,10 @@ func (s *session) handleEhlo(args []string) error {
 	if err != nil {
 		return err
 	}
+	s.helo = client
+	s.esmtp = true
 	s.pastHello = true
+	s.resetMail()
 	return nil
 }
 
@@ -177,7 +262,20 @@ func (s *session) handleMail(args []string) {
 		s.ErrCmd(CodeMailboxNameNotAllowed)
 		return
 	}
+	params, err := parseParams(args[2:])
+	if err != nil {
+		s.ErrCmd(CodeSyntaxError)
+		return
+	}
+	if rl := s.server.RateLimiter; rl != nil {
+		if !rl.allowMessage(s.server, s.conn.RemoteAddr(), from.Address, s.auth) {
+			s.Cmd(CodeMailboxNotAvailable, "4.7.1 Message rate limit exceeded, try again later")
+			return
+		}
+	}
 	s.mail.From = from.Address
+	s.mail.Params = params
+	s.wait = s.server.mailTimeout()
 	s.Cmd(CodeOk, "OK")
 	return
 
@@ -203,48 +301,44 @@ func (s *session) handleRcpt(args []string) {
 		s.ErrCmd(CodeMailboxNameNotAllowed)
 		return
 	}
+	if rl := s.server.RateLimiter; rl != nil {
+		if !rl.allowRecipient(len(s.mail.Rcpts)) {
+			s.Cmd(CodeInsufficientStorage, "4.5.3 Too many recipients")
+			return
+		}
+	}
+	if err := s.checkRcpt(rcpt.Address); err != nil {
+		var serr *SMTPError
+		if errors.As(err, &serr) {
+			s.Cmd(serr.Code, "%s", serr.reply())
+		} else {
+			s.server.logf("Error checking recipient %s: %s", rcpt.Address, err)
+			s.Cmd(CodeAborted, "4.3.0 Could not check recipient")
+		}
+		return
+	}
 	s.mail.Rcpts = append(s.mail.Rcpts, rcpt.Address)
+	s.wait = s.server.rcptTimeout()
 	s.Cmd(CodeOk, "OK")
 	return
 
 }
 
-// compare list of RCPTs with recepients found in MIME header
-// return true if all recepients could be found in either list, false if not.
-// Error contains how many recepients could not be matched.
-func (s *session) rcptMimeMatch(header mail.Header) (bool, error) {
-	// unique recepients, bool is false if key was not found in MIME header
-	uRecepients := make(map[string]bool)
-	// list of destination field names
-	fields := []string{"To", "Cc", "Bcc"}
-	// mismatch counter
-	count := 0
-	for _, rcpt := range s.mail.Rcpts {
-		uRecepients[rcpt] = false
-		for _, key := range fields {
-			addresses, err := header.AddressList(key)
-			if err != nil {
-				continue
-			}
-			for _, addr := range addresses {
-				// check if exists and write appropriate value into fields
-				if _, ok := uRecepients[addr.Address]; ok {
-					uRecepients[addr.Address] = true
-				} else {
-					uRecepients[addr.Address] = false
-				}
-			}
-		}
+// checkRcpt asks the RcptChecker of the server whether it accepts mail for
+// rcpt.
+func (s *session) checkRcpt(rcpt string) error {
+	checker := s.server.RcptChecker
+	if checker == nil {
+		checker, _ = s.server.Handler.(RcptChecker)
 	}
-	for _, uRcpt := range uRecepients {
-		if !uRcpt {
-			count++
-		}
+	if checker == nil {
+		return nil
 	}
-	if count != 0 {
-		return false, fmt.Errorf("recepient mismatch for %d RCPTs", count)
+	var size int64
+	if v, ok := s.mail.Params["SIZE"]; ok {
+		size, _ = strconv.ParseInt(v, 10, 64)
 	}
-	return true, nil
+	return checker.CheckRcpt(s.ctx, s.mail.From, rcpt, size)
 }
 
 func (s *session) handleData(args []string) error {
@@ -256,14 +350,60 @@ func (s *session) handleData(args []string) error {
 		s.Cmd(CodeBadSequence, "RCPT sequnce must come before DATA")
 		return nil
 	}
+	s.mail.ReceivedAt = time.Now()
+	s.conn.expect(s.server.dataInitTimeout(), s.server.dataBlockTimeout())
 	s.Cmd(CodeStartMailInput, "Ready to receive mails end with single . line")
-
-	dataReader := s.text.DotReader()
-	s.mail.PutMessage(dataReader)
-
-	code, err := s.handle(s.mail)
+	// whatever happens, the transaction ends with this DATA command.
+	defer s.resetMail()
+
+	// the handler gets DataTermTimeout once the final dot was read, the
+	// upload itself is limited by DataBlockTimeout only.
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	termTimer := time.AfterFunc(time.Duration(math.MaxInt64), cancel)
+	defer termTimer.Stop()
+	data := newDataReader(s.text.R)
+	data.onEnd = func() { termTimer.Reset(s.server.dataTermTimeout()) }
+	s.mail.putMessage(data, s.server.SpoolMemoryLimit, s.server.SpoolDir)
+	defer s.mail.Close()
+	if s.server.AddReceivedHeader {
+		s.mail.PrependHeader("Received", s.mail.receivedHeader(s.server.Name))
+	}
+
+	if s.server.DeliveryMode == DeliverReceived || s.server.Validation != ValidateNone {
+		if err := s.mail.Receive(); err != nil {
+			return s.dataFailed(err)
+		}
+	}
+	if s.server.Validation != ValidateNone {
+		if err := s.validate(data); err != nil {
+			return s.rejectData(err)
+		}
+	}
+	if err := checkLoop(s.mail, s.server.maxHops()); err != nil {
+		return s.rejectData(err)
+	}
+	if err := s.checkRecipients(); err != nil {
+		return s.rejectData(err)
+	}
+	s.mail.ctx = ctx
+	code, err := s.handle(ctx, s.mail)
+	// whatever the handler read, the rest of the message must not be taken
+	// for commands.
+	if derr := s.mail.mailBuf.drain(); derr != nil {
+		return s.dataFailed(derr)
+	}
 	if err != nil {
-		s.ErrCmd(CodeNotTaken)
+		var serr *SMTPError
+		if errors.As(err, &serr) {
+			s.Cmd(serr.Code, "%s", serr.reply())
+		} else if ctx.Err() != nil {
+			// the handler gave up because it ran out of time, the client
+			// may try again.
+			s.Cmd(CodeAborted, "4.3.0 Processing aborted")
+		} else {
+			s.ErrCmd(CodeNotTaken)
+		}
 		return fmt.Errorf("failed to handle mail: %s", err)
 	}
 	if code != 0 && code != CodeOk {
@@ -274,6 +414,32 @@ func (s *session) handleData(args []string) error {
 	return nil
 }
 
+// rejectData rejects a message before it is handled. The rest of the message
+// is read before the client gets the reply.
+func (s *session) rejectData(err error) error {
+	if derr := s.mail.mailBuf.drain(); derr != nil {
+		return s.dataFailed(derr)
+	}
+	var serr *SMTPError
+	if errors.As(err, &serr) {
+		s.Cmd(serr.Code, "%s", serr.reply())
+	} else {
+		s.ErrCmd(CodeTransactionFailed)
+	}
+	return fmt.Errorf("rejected mail: %s", err)
+}
+
+// dataFailed ends a session whose message data could not be received.
+func (s *session) dataFailed(err error) error {
+	if s.conn.timedout {
+		s.handleTimeout()
+		return fmt.Errorf("timeout while receiving data")
+	}
+	s.active = false
+	s.Close()
+	return fmt.Errorf("failed to receive data: %s", err)
+}
+
 func (s *session) handleRset(args []string) {
 	s.reset()
 	s.Cmd(CodeOk, "OK")
@@ -318,27 +484,51 @@ func (s *session) serverHello(server string) {
 
 func (srv *Server) handleConnection(conn net.Conn, starttls bool) {
 	t := time.Now()
-	s := NewSession(conn, srv)
+	s := newSession(conn, srv)
 	s.starttls = starttls
-	s.handle = srv.Handler.HandleMail
+	srv.trackSession(s, true)
+	defer srv.trackSession(s, false)
+	defer s.cancel()
+	defer s.recoverPanic()
+	s.handle = func(ctx context.Context, m *Mail) (int, error) {
+		return handleMail(ctx, srv.Handler, m)
+	}
 
 	if !s.starttls {
+		if srv.RateLimiter != nil && !srv.RateLimiter.allowConnection(srv, conn.RemoteAddr()) {
+			s.Cmd(CodeNotAvailable, "4.7.0 %s Too many connections, try again later", srv.Name)
+			s.Close()
+			return
+		}
 		s.serverHello(srv.Name)
 	} else {
 		srv.logf("Starttls session with %s", conn.RemoteAddr())
 	}
 	for s.active {
-		// reset timeout to prevent clients from dangling around
-		s.ResetTimeout()
+		// prevent clients from dangling around
+		s.conn.expect(s.wait, s.wait)
+		s.wait = srv.commandTimeout()
+		if s.mail.From == "" {
+			if srv.shuttingDown() {
+				s.handleShutdown()
+				return
+			}
+			atomic.StoreInt32(&s.idle, 1)
+		}
 		line, err := s.text.ReadLine()
+		atomic.StoreInt32(&s.idle, 0)
 		if err != nil {
-			if !s.timedout {
-				srv.logf("Error reading line: %s", err)
+			if srv.shuttingDown() && s.mail.From == "" {
+				s.handleShutdown()
+				return
+			}
+			if s.conn.timedout {
+				s.handleTimeout()
+				return
 			}
+			srv.logf("Error reading line: %s", err)
 			return
 		}
-		// Stop the timout for the time beeing, we are in the middle of something
-		s.timeout.Reset(processingTimeout)
 		args := strings.Fields(line)
 		if len(args) == 0 {
 			continue
@@ -409,6 +599,7 @@ func (srv *Server) startTls(conn net.Conn) error {
 		return fmt.Errorf("TLS Config was not set")
 	}
 	tlsConn := tls.Server(conn, srv.TLSConfig)
+	conn.SetDeadline(time.Now().Add(srv.commandTimeout()))
 	err := tlsConn.Handshake()
 	if err != nil {
 		return err
@@ -418,6 +609,20 @@ func (srv *Server) startTls(conn net.Conn) error {
 
 }
 
+// DeliveryMode decides when the server calls its Handler.
+type DeliveryMode int
+
+const (
+	// DeliverStreaming calls the Handler as soon as the client starts to
+	// send the message. The Handler reads the message while it is
+	// received. This is the default.
+	DeliverStreaming DeliveryMode = iota
+	// DeliverReceived calls the Handler after the whole message was
+	// received and its end was seen. If the client disconnects or times
+	// out before, the Handler is not called.
+	DeliverReceived
+)
+
 // Server type that implements a simple smtp server
 type Server struct {
 	Addr    string  //TCP address to listen on, ":smtp" if empty
@@ -430,6 +635,68 @@ type Server struct {
 
 	// Error Logger, if nil logs are sent to os.Stderr.
 	ErrorLog *log.Logger
+
+	// Timeouts for the phases of a session as described in rfc5321
+	// 4.5.3.2. GreetingTimeout, MailTimeout and RcptTimeout limit how long
+	// the client may take to send the next command after the greeting, MAIL
+	// and RCPT, CommandTimeout after all other commands. DataInitTimeout and
+	// DataBlockTimeout limit the reads of the message data.
+	// DataTermTimeout bounds the processing of a message by the Handler
+	// after the final dot was received, the context returned by
+	// Mail.Context is cancelled when it expires. If a
+	// timeout is zero the matching Default value is used. When a timeout
+	// expires the client receives a 421 and is disconnected.
+	GreetingTimeout  time.Duration
+	MailTimeout      time.Duration
+	RcptTimeout      time.Duration
+	DataInitTimeout  time.Duration
+	DataBlockTimeout time.Duration
+	DataTermTimeout  time.Duration
+	CommandTimeout   time.Duration
+
+	// Messages larger than SpoolMemoryLimit bytes are spooled to a
+	// temporary file in SpoolDir while they are processed. If zero,
+	// DefaultSpoolMemoryLimit is used, if SpoolDir is empty the default
+	// directory for temporary files is used.
+	SpoolMemoryLimit int64
+	SpoolDir         string
+
+	// DeliveryMode decides whether the Handler is called as soon as the
+	// client starts to send the message or after it was received
+	// completely. See DeliveryMode for details.
+	DeliveryMode DeliveryMode
+
+	// Validation decides whether messages are checked against rfc5322
+	// and what happens to those that fail. See ValidationMode for details.
+	Validation ValidationMode
+
+	// AddReceivedHeader puts a Received trace field as described in rfc5321
+	// 4.4 in front of every message.
+	AddReceivedHeader bool
+
+	// MaxHops is the number of Received fields a message may have before
+	// it is rejected as a mail loop. If zero, DefaultMaxHops is used, if
+	// negative hops are not counted. Messages that carry a Delivered-To
+	// field for one of their recipients are always rejected.
+	MaxHops int
+
+	// RateLimiter limits connections, messages and recipients per client.
+	// If nil no limits are enforced.
+	RateLimiter *RateLimiter
+
+	// RecipientCheck compares the envelope recipients with the recipients
+	// named in the message header. If nil messages are not checked.
+	RecipientCheck *RecipientCheck
+
+	// RcptChecker is asked at RCPT time whether a recipient is accepted.
+	// If nil the Handler is asked if it implements RcptChecker.
+	RcptChecker RcptChecker
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	sessions   map[*session]struct{}
+	onShutdown []func()
+	inShutdown int32 // 1 once the server is closed or shut down, atomic
 }
 
 func (srv *Server) logf(format string, args ...interface{}) {
@@ -474,7 +741,7 @@ func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
 	}
 	config := &tls.Config{}
 	if srv.TLSConfig != nil {
-		*config = *srv.TLSConfig
+		config = srv.TLSConfig.Clone()
 	}
 
 	var err error
@@ -504,9 +771,16 @@ func (srv *Server) Serve(l net.Listener) error {
 		}
 		srv.Name = name
 	}
+	if !srv.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer srv.trackListener(l, false)
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
 			srv.logf("Error During Connect: %s", err)
 			continue
 		}
@@ -520,7 +794,7 @@ func (srv *Server) Serve(l net.Listener) error {
 //
 // A trivial example server is:
 //
-// 	import (
+//	import (
 //		"fmt"
 //		"io"
 //		"lmail"
@@ -558,7 +832,7 @@ func ListenAndServe(addr string, handler Handler) error {
 //
 // A trivial example server is:
 //
-// 	import (
+//	import (
 //		"fmt"
 //		"io"
 //		"lmail"
@@ -1,11 +1,17 @@
 package lmail
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/mail"
 	"net/smtp"
+	"net/textproto"
+	"strings"
 	"testing"
 	"time"
 )
@@ -32,6 +38,11 @@ func TestConnection(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	for _, ext := range []string{"8BITMIME", "SIZE", "STARTTLS"} {
+		if ok, _ := c.Extension(ext); !ok {
+			t.Errorf("%s not advertised", ext)
+		}
+	}
 	// Set the sender and recipient first
 	if err := c.Mail("sender@example.org"); err != nil {
 		t.Fatal(err)
@@ -98,7 +109,7 @@ func BenchmarkConnections(b *testing.B) {
 		if err != nil {
 			b.Fatal(err)
 		}
-		_, err = fmt.Fprintf(wc, mailstring)
+		_, err = fmt.Fprint(wc, mailstring)
 		if err != nil {
 			b.Fatal(err)
 		}
@@ -115,3 +126,324 @@ func BenchmarkConnections(b *testing.B) {
 	}
 	return
 }
+
+// pipeSession serves a session of srv over an in memory connection and
+// returns the client side of it.
+func pipeSession(t testing.TB, srv *Server) *textproto.Conn {
+	client, server := net.Pipe()
+	go srv.handleConnection(server, false)
+	return textproto.NewConn(client)
+}
+
+// expect sends cmd, unless it is empty, and checks that the server replies
+// with code.
+func expect(t testing.TB, text *textproto.Conn, cmd string, code int) {
+	if cmd != "" {
+		if err := text.PrintfLine("%s", cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, msg, err := text.ReadResponse(code); err != nil {
+		t.Fatalf("%s: %s", cmd, err)
+	} else if testing.Verbose() {
+		t.Logf("%s: %d %s", cmd, code, msg)
+	}
+}
+
+func TestGreetingTimeout(t *testing.T) {
+	srv := &Server{Name: "test", Handler: &NullHandler{}, GreetingTimeout: 50 * time.Millisecond}
+	text := pipeSession(t, srv)
+	defer text.Close()
+	expect(t, text, "", CodeReady)
+	expect(t, text, "", CodeNotAvailable)
+}
+
+func TestHandlerPanic(t *testing.T) {
+	handler := HandlerFunc(func(m *Mail) (int, error) {
+		panic("handler failure")
+	})
+	srv := &Server{Name: "test", Handler: handler}
+	text := pipeSession(t, srv)
+	defer text.Close()
+	expect(t, text, "", CodeReady)
+	expect(t, text, "HELO localhost", CodeOk)
+	expect(t, text, "MAIL FROM:<sender@example.org>", CodeOk)
+	expect(t, text, "RCPT TO:<recipient@example.net>", CodeOk)
+	expect(t, text, "DATA", CodeStartMailInput)
+	w := text.DotWriter()
+	fmt.Fprint(w, "Subject: panic\n\nbody\n")
+	w.Close()
+	expect(t, text, "", CodeAborted)
+	if _, err := text.ReadLine(); err == nil {
+		t.Fatal("connection was not closed")
+	}
+}
+
+func TestMuxerPanic(t *testing.T) {
+	var logs bytes.Buffer
+	mux := NewDefaultMuxer()
+	mux.AddRcptHandler("panic@example.net", HandlerFunc(func(m *Mail) (int, error) {
+		panic("muxed handler failure")
+	}))
+	srv := &Server{Name: "test", Handler: mux, ErrorLog: log.New(&logs, "", 0)}
+	text := pipeSession(t, srv)
+	defer text.Close()
+	expect(t, text, "", CodeReady)
+	expect(t, text, "HELO localhost", CodeOk)
+	expect(t, text, "MAIL FROM:<sender@example.org>", CodeOk)
+	expect(t, text, "RCPT TO:<recipient@example.net>", CodeOk)
+	expect(t, text, "RCPT TO:<panic@example.net>", CodeOk)
+	expect(t, text, "DATA", CodeStartMailInput)
+	w := text.DotWriter()
+	fmt.Fprint(w, "Subject: panic\n\nbody\n")
+	w.Close()
+	expect(t, text, "", CodeAborted)
+	if _, err := text.ReadLine(); err == nil {
+		t.Fatal("connection was not closed")
+	}
+	if !strings.Contains(logs.String(), "muxed handler failure") {
+		t.Errorf("panic was not logged to ErrorLog: %q", logs.String())
+	}
+}
+
+func TestMailMetadata(t *testing.T) {
+	mails := make(chan Mail, 2)
+	handler := HandlerFunc(func(m *Mail) (int, error) {
+		mails <- *m
+		return CodeOk, nil
+	})
+	srv := &Server{Name: "test", Handler: handler}
+	start := time.Now()
+	text := pipeSession(t, srv)
+	defer text.Close()
+	expect(t, text, "", CodeReady)
+	expect(t, text, "HELO client.example.org", CodeOk)
+	for i := 0; i < 2; i++ {
+		expect(t, text, "MAIL FROM:<sender@example.org> BODY=8BITMIME size=20", CodeOk)
+		expect(t, text, "RCPT TO:<rcpt@example.net>", CodeOk)
+		expect(t, text, "DATA", CodeStartMailInput)
+		w := text.DotWriter()
+		fmt.Fprint(w, "Subject: metadata\n\nbody\n")
+		w.Close()
+		expect(t, text, "", CodeOk)
+	}
+	first, second := <-mails, <-mails
+	for _, m := range []Mail{first, second} {
+		if m.From != "sender@example.org" || len(m.Rcpts) != 1 || m.Rcpts[0] != "rcpt@example.net" {
+			t.Errorf("envelope %s %v", m.From, m.Rcpts)
+		}
+		if m.ClientName != "client.example.org" || m.ESMTP {
+			t.Errorf("client %q esmtp %v", m.ClientName, m.ESMTP)
+		}
+		if m.Params["BODY"] != "8BITMIME" || m.Params["SIZE"] != "20" {
+			t.Errorf("params %v", m.Params)
+		}
+		if m.RemoteAddr == nil || m.LocalAddr == nil || m.TLS != nil || m.AuthIdentity != "" {
+			t.Errorf("connection %v %v %v %q", m.RemoteAddr, m.LocalAddr, m.TLS, m.AuthIdentity)
+		}
+		if m.ConnectedAt.Before(start) || m.ReceivedAt.Before(m.ConnectedAt) {
+			t.Errorf("connected at %s, received at %s", m.ConnectedAt, m.ReceivedAt)
+		}
+	}
+	if first.SessionID == "" || first.SessionID != second.SessionID {
+		t.Errorf("session ids %q and %q", first.SessionID, second.SessionID)
+	}
+	if first.QueueID == "" || first.QueueID == second.QueueID {
+		t.Errorf("queue ids %q and %q", first.QueueID, second.QueueID)
+	}
+	if !first.ConnectedAt.Equal(second.ConnectedAt) || second.ReceivedAt.Before(first.ReceivedAt) {
+		t.Error("timestamps do not belong to one session")
+	}
+}
+
+func TestUnreadDataIsDrained(t *testing.T) {
+	handler := HandlerFunc(func(m *Mail) (int, error) {
+		return CodeOk, nil
+	})
+	for _, mode := range []DeliveryMode{DeliverStreaming, DeliverReceived} {
+		srv := &Server{Name: "test", Handler: handler, DeliveryMode: mode}
+		text := pipeSession(t, srv)
+		expect(t, text, "", CodeReady)
+		expect(t, text, "HELO localhost", CodeOk)
+		expect(t, text, "MAIL FROM:<sender@example.org>", CodeOk)
+		expect(t, text, "RCPT TO:<recipient@example.net>", CodeOk)
+		expect(t, text, "DATA", CodeStartMailInput)
+		w := text.DotWriter()
+		fmt.Fprint(w, "Subject: drain\n\nQUIT\nMAIL FROM:<evil@example.org>\n")
+		w.Close()
+		expect(t, text, "", CodeOk)
+		expect(t, text, "NOOP", CodeOk)
+		text.Close()
+	}
+}
+
+func TestDataTermTimeoutStartsAfterData(t *testing.T) {
+	handler := ContextHandlerFunc(func(ctx context.Context, m *Mail) (int, error) {
+		if _, err := ioutil.ReadAll(m.RawReader()); err != nil {
+			return CodeAborted, err
+		}
+		if err := ctx.Err(); err != nil {
+			return CodeAborted, err
+		}
+		return CodeOk, nil
+	})
+	srv := &Server{Name: "test", Handler: handler, DataTermTimeout: 50 * time.Millisecond}
+	text := pipeSession(t, srv)
+	defer text.Close()
+	expect(t, text, "", CodeReady)
+	expect(t, text, "HELO localhost", CodeOk)
+	expect(t, text, "MAIL FROM:<sender@example.org>", CodeOk)
+	expect(t, text, "RCPT TO:<recipient@example.net>", CodeOk)
+	expect(t, text, "DATA", CodeStartMailInput)
+	w := text.DotWriter()
+	fmt.Fprint(w, "Subject: slow\n\n")
+	for i := 0; i < 4; i++ {
+		time.Sleep(30 * time.Millisecond)
+		fmt.Fprintf(w, "line %d\n", i)
+		text.W.Flush()
+	}
+	w.Close()
+	expect(t, text, "", CodeOk)
+}
+
+func TestDataTermTimeoutCancelsHandler(t *testing.T) {
+	handler := ContextHandlerFunc(func(ctx context.Context, m *Mail) (int, error) {
+		if _, err := ioutil.ReadAll(m.RawReader()); err != nil {
+			return CodeAborted, err
+		}
+		select {
+		case <-ctx.Done():
+			return CodeAborted, ctx.Err()
+		case <-time.After(2 * time.Second):
+			return CodeOk, nil
+		}
+	})
+	srv := &Server{Name: "test", Handler: handler, DataTermTimeout: 50 * time.Millisecond}
+	text := pipeSession(t, srv)
+	defer text.Close()
+	expect(t, text, "", CodeReady)
+	expect(t, text, "HELO localhost", CodeOk)
+	expect(t, text, "MAIL FROM:<sender@example.org>", CodeOk)
+	expect(t, text, "RCPT TO:<recipient@example.net>", CodeOk)
+	expect(t, text, "DATA", CodeStartMailInput)
+	w := text.DotWriter()
+	fmt.Fprint(w, "Subject: blocking\n\nbody\n")
+	w.Close()
+	sent := time.Now()
+	expect(t, text, "", CodeAborted)
+	if d := time.Since(sent); d > time.Second {
+		t.Errorf("handler was cancelled after %s", d)
+	}
+	expect(t, text, "NOOP", CodeOk)
+}
+
+// sendMail runs a mail transaction and checks the final reply.
+func sendMail(t testing.TB, text *textproto.Conn, rcpt, msg string, code int) {
+	expect(t, text, "MAIL FROM:<sender@example.org>", CodeOk)
+	expect(t, text, "RCPT TO:<"+rcpt+">", CodeOk)
+	expect(t, text, "DATA", CodeStartMailInput)
+	w := text.DotWriter()
+	fmt.Fprint(w, msg)
+	w.Close()
+	expect(t, text, "", code)
+}
+
+func TestMailLoop(t *testing.T) {
+	srv := &Server{Name: "test", Handler: &NullHandler{}, MaxHops: 2}
+	text := pipeSession(t, srv)
+	defer text.Close()
+	expect(t, text, "", CodeReady)
+	expect(t, text, "HELO localhost", CodeOk)
+	hops := "Received: from a by b\nReceived: from b by c\n"
+	sendMail(t, text, "rcpt@example.net", hops+"Subject: ok\n\nbody\n", CodeOk)
+	sendMail(t, text, "rcpt@example.net", hops+"Received: from c by d\nSubject: loop\n\nbody\n", CodeTransactionFailed)
+	sendMail(t, text, "rcpt@example.net", "Delivered-To: rcpt@example.net\nSubject: loop\n\nbody\n", CodeTransactionFailed)
+	sendMail(t, text, "other@example.net", "Delivered-To: rcpt@example.net\nSubject: ok\n\nbody\n", CodeOk)
+}
+
+func TestValidation(t *testing.T) {
+	srv := &Server{Name: "test", Handler: &NullHandler{}, Validation: ValidateStrict}
+	text := pipeSession(t, srv)
+	defer text.Close()
+	expect(t, text, "", CodeReady)
+	expect(t, text, "HELO localhost", CodeOk)
+	sendMail(t, text, "rcpt@example.net", "From: a@example.org\nDate: Mon, 2 Jan 2006 15:04:05 -0700\n\nbody\n", CodeOk)
+	sendMail(t, text, "rcpt@example.net", "From: a@example.org\n\nbody\n", CodeNotTaken)
+	sendMail(t, text, "rcpt@example.net", "From: a@example.org\nDate: Mon, 2 Jan 2006 15:04:05 -0700\n\n"+strings.Repeat("x", 1000)+"\n", CodeNotTaken)
+
+	var header mail.Header
+	srv = &Server{Name: "test", Validation: ValidateFixup}
+	srv.Handler = HandlerFunc(func(m *Mail) (int, error) {
+		msg, err := mail.ReadMessage(m.RawReader())
+		if err != nil {
+			return 0, err
+		}
+		header = msg.Header
+		return CodeOk, nil
+	})
+	text = pipeSession(t, srv)
+	defer text.Close()
+	expect(t, text, "", CodeReady)
+	expect(t, text, "HELO localhost", CodeOk)
+	sendMail(t, text, "rcpt@example.net", "Subject: no from\n\nbody\n", CodeNotTaken)
+	sendMail(t, text, "rcpt@example.net", "From: a@example.org\n\nbody\n", CodeOk)
+	if header.Get("Date") == "" || header.Get("Message-Id") == "" {
+		t.Errorf("missing fields were not added: %v", header)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Name: "test", Handler: &NullHandler{}}
+	stopped := make(chan bool, 1)
+	srv.RegisterOnShutdown(func() { stopped <- true })
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	text, err := textproto.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer text.Close()
+	expect(t, text, "", CodeReady)
+	expect(t, text, "HELO localhost", CodeOk)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown failed: %s", err)
+	}
+	if _, _, err := text.ReadResponse(CodeNotAvailable); err != nil {
+		t.Errorf("idle session was not closed: %s", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve returned %v", err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("shutdown hook was not called")
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	srv := &Server{Name: "test", Handler: &NullHandler{}, RateLimiter: &RateLimiter{
+		MessagesPerHour:      1,
+		RecipientsPerMessage: 1,
+	}}
+	text := pipeSession(t, srv)
+	defer text.Close()
+	expect(t, text, "", CodeReady)
+	expect(t, text, "HELO localhost", CodeOk)
+	// a command that fails to parse takes no token
+	expect(t, text, "MAIL FROM:<sender@example.org> =broken", CodeSyntaxError)
+	expect(t, text, "MAIL FROM:<sender@example.org>", CodeOk)
+	expect(t, text, "RCPT TO:<a@example.net>", CodeOk)
+	expect(t, text, "RCPT TO:<b@example.net>", CodeInsufficientStorage)
+	expect(t, text, "RSET", CodeOk)
+	expect(t, text, "HELO localhost", CodeOk)
+	expect(t, text, "MAIL FROM:<other@example.org>", CodeMailboxNotAvailable)
+}
@@ -0,0 +1,129 @@
+package lmail
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve, ListenAndServe and ListenAndServeTLS
+// after the server was closed or shut down.
+var ErrServerClosed = errors.New("lmail: Server closed")
+
+// how often Shutdown checks whether all sessions have ended
+const shutdownPollInterval = 100 * time.Millisecond
+
+func (srv *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&srv.inShutdown) == 1
+}
+
+// RegisterOnShutdown registers a function to call when the server is closed
+// or shut down, e.g. to stop background work like a Maildir janitor.
+func (srv *Server) RegisterOnShutdown(f func()) {
+	srv.mu.Lock()
+	srv.onShutdown = append(srv.onShutdown, f)
+	srv.mu.Unlock()
+}
+
+// trackListener adds or removes a listener that is closed on shutdown. It
+// returns false if the server is shut down already.
+func (srv *Server) trackListener(l net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.Listener]struct{})
+	}
+	if !add {
+		delete(srv.listeners, l)
+		return true
+	}
+	if srv.shuttingDown() {
+		return false
+	}
+	srv.listeners[l] = struct{}{}
+	return true
+}
+
+func (srv *Server) trackSession(s *session, add bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.sessions == nil {
+		srv.sessions = make(map[*session]struct{})
+	}
+	if add {
+		srv.sessions[s] = struct{}{}
+	} else {
+		delete(srv.sessions, s)
+	}
+}
+
+// shutdown stops accepting connections and calls the functions registered
+// with RegisterOnShutdown. Only the first call does anything.
+func (srv *Server) shutdown() error {
+	if !atomic.CompareAndSwapInt32(&srv.inShutdown, 0, 1) {
+		return nil
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	var err error
+	for l := range srv.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(srv.listeners, l)
+	}
+	for _, f := range srv.onShutdown {
+		go f()
+	}
+	return err
+}
+
+// Close closes all listeners and the connections of all sessions
+// immediately. Mails that are being received are lost, clients retry them
+// later.
+func (srv *Server) Close() error {
+	err := srv.shutdown()
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for s := range srv.sessions {
+		s.conn.Conn.Close()
+	}
+	return err
+}
+
+// Shutdown stops the server gracefully. It closes all listeners, then waits
+// for the sessions to end. Sessions that wait for a command outside of a mail
+// transaction are told that the service shuts down and closed, transactions
+// in progress are completed. If ctx is done before all sessions have ended,
+// its error is returned and the remaining sessions keep running, call Close
+// to end them.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	err := srv.shutdown()
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if srv.closeIdleSessions() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeIdleSessions interrupts sessions that wait for a command outside of a
+// transaction. It reports whether all sessions have ended.
+func (srv *Server) closeIdleSessions() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for s := range srv.sessions {
+		if atomic.LoadInt32(&s.idle) == 1 {
+			s.conn.Conn.SetReadDeadline(time.Now())
+		}
+	}
+	return len(srv.sessions) == 0
+}
@@ -0,0 +1,105 @@
+package lmail
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Default timeouts as proposed in rfc5321 4.5.3.2. They are used if the
+// corresponding Server field is zero.
+const (
+	DefaultGreetingTimeout  = 5 * time.Minute  // 4.5.3.2.1
+	DefaultMailTimeout      = 5 * time.Minute  // 4.5.3.2.2
+	DefaultRcptTimeout      = 5 * time.Minute  // 4.5.3.2.3
+	DefaultDataInitTimeout  = 2 * time.Minute  // 4.5.3.2.4
+	DefaultDataBlockTimeout = 3 * time.Minute  // 4.5.3.2.5
+	DefaultDataTermTimeout  = 10 * time.Minute // 4.5.3.2.6
+	DefaultCommandTimeout   = 5 * time.Minute  // 4.5.3.2.7
+)
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+func (srv *Server) greetingTimeout() time.Duration {
+	return orDefault(srv.GreetingTimeout, DefaultGreetingTimeout)
+}
+
+func (srv *Server) mailTimeout() time.Duration {
+	return orDefault(srv.MailTimeout, DefaultMailTimeout)
+}
+
+func (srv *Server) rcptTimeout() time.Duration {
+	return orDefault(srv.RcptTimeout, DefaultRcptTimeout)
+}
+
+func (srv *Server) dataInitTimeout() time.Duration {
+	return orDefault(srv.DataInitTimeout, DefaultDataInitTimeout)
+}
+
+func (srv *Server) dataBlockTimeout() time.Duration {
+	return orDefault(srv.DataBlockTimeout, DefaultDataBlockTimeout)
+}
+
+func (srv *Server) dataTermTimeout() time.Duration {
+	return orDefault(srv.DataTermTimeout, DefaultDataTermTimeout)
+}
+
+func (srv *Server) commandTimeout() time.Duration {
+	return orDefault(srv.CommandTimeout, DefaultCommandTimeout)
+}
+
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
+
+// timeoutConn renews the deadline of the connection before every read and
+// write. The session sets the timeout for the phase it is in, then applies
+// to all reads that follow, next only to the first of them.
+type timeoutConn struct {
+	net.Conn
+	next     time.Duration // timeout for the next read only
+	then     time.Duration // timeout for all other reads
+	write    time.Duration // timeout for writes
+	timedout bool          // true once a read or write timed out
+
+	// cancel is called when reading or writing fails, the client is gone
+	// or too slow.
+	cancel context.CancelFunc
+}
+
+// expect sets the timeout for the next read and the reads that follow.
+func (c *timeoutConn) expect(next, then time.Duration) {
+	c.next = next
+	c.then = then
+}
+
+func (c *timeoutConn) Read(p []byte) (n int, err error) {
+	d := c.then
+	if c.next > 0 {
+		d = c.next
+		c.next = 0
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(d))
+	n, err = c.Conn.Read(p)
+	if err != nil {
+		c.timedout = c.timedout || isTimeout(err)
+		c.cancel()
+	}
+	return
+}
+
+func (c *timeoutConn) Write(p []byte) (n int, err error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.write))
+	n, err = c.Conn.Write(p)
+	if err != nil {
+		c.timedout = c.timedout || isTimeout(err)
+		c.cancel()
+	}
+	return
+}
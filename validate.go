@@ -0,0 +1,89 @@
+package lmail
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// ValidationMode decides how the server checks that messages are well formed
+// as described in rfc5322.
+//
+// Every mode but ValidateNone makes the server receive the whole message
+// before the Handler is called. The checks find missing or repeated From and
+// Date fields, lines longer than 998 octets, lines ending in a bare LF and
+// 8-bit data in messages that were not announced with BODY=8BITMIME.
+type ValidationMode int
+
+const (
+	// ValidateNone accepts any message, this is the default.
+	ValidateNone ValidationMode = iota
+	// ValidateLenient accepts messages with violations but records them
+	// in Mail.Violations.
+	ValidateLenient
+	// ValidateStrict rejects messages with violations.
+	ValidateStrict
+	// ValidateFixup adds the Date and Message-ID fields if they are
+	// missing, as a submission server should (rfc6409 8). The remaining
+	// violations are recorded like with ValidateLenient, except a missing
+	// From field that rejects the message.
+	ValidateFixup
+)
+
+func violation(code int, enhanced, format string, args ...interface{}) *SMTPError {
+	return &SMTPError{code, enhanced, fmt.Sprintf(format, args...)}
+}
+
+// validate checks a completely received message. It records the violations
+// on the mail and returns the one the message is rejected for, if any.
+func (s *session) validate(data *dataReader) error {
+	mode := s.server.Validation
+	m := s.mail
+	var violations []error
+	var header mail.Header
+
+	msg, err := m.MimeMessage()
+	if err != nil {
+		violations = append(violations, violation(CodeNotTaken, "5.6.0", "Message header malformed: %s", err))
+	} else {
+		header = msg.Header
+	}
+	for _, key := range []string{"From", "Date"} {
+		switch n := len(header[key]); {
+		case n == 0 && header != nil:
+			if key == "Date" && mode == ValidateFixup {
+				m.AddHeader("Date", time.Now().Format(time.RFC1123Z))
+				continue
+			}
+			violations = append(violations, violation(CodeNotTaken, "5.6.0", "Message has no %s field", key))
+			if key == "From" && mode == ValidateFixup {
+				m.Violations = violations
+				return violations[len(violations)-1]
+			}
+		case n > 1:
+			violations = append(violations, violation(CodeNotTaken, "5.6.0", "Message has more than one %s field", key))
+		}
+	}
+	if header != nil && len(header["Message-Id"]) == 0 && mode == ValidateFixup {
+		m.AddHeader("Message-ID", fmt.Sprintf("<%s.%d@%s>", m.QueueID, time.Now().Unix(), s.server.Name))
+	}
+	if data.longLine {
+		violations = append(violations, violation(CodeNotTaken, "5.6.0", "Line longer than %d octets", maxLineLength))
+	}
+	if data.bareLF {
+		violations = append(violations, violation(CodeNotTaken, "5.6.0", "Bare LF line ending"))
+	}
+	if data.eightBit {
+		switch strings.ToUpper(m.Params["BODY"]) {
+		case "8BITMIME", "BINARYMIME":
+		default:
+			violations = append(violations, violation(CodeNotTaken, "5.6.1", "8-bit data without BODY=8BITMIME"))
+		}
+	}
+	m.Violations = violations
+	if mode == ValidateStrict && len(violations) > 0 {
+		return violations[0]
+	}
+	return nil
+}